@@ -1,65 +1,73 @@
 package cmdx
 
 import (
-	"chihqiang/depctl/flagx"
+	"chihqiang/depctl/depx"
 	"chihqiang/depctl/sshx"
 	"chihqiang/depctl/utilx"
 	"context"
+	"fmt"
 	"sort"
 	"strconv"
+	"sync"
+	"time"
 
-	"github.com/chihqiang/logx"
 	"github.com/urfave/cli/v3"
 )
 
 // History returns a CLI command for viewing deployment history on remote hosts
 func History() *cli.Command {
 	return &cli.Command{
-		Name:  "history",
-		Usage: "Peek into your app's past glory",
-		Flags: []cli.Flag{},
+		Name:      "history",
+		Usage:     "Peek into your app's past glory",
+		ArgsUsage: "[stage]",
+		Flags:     []cli.Flag{},
 		Action: func(ctx context.Context, command *cli.Command) error {
 			// 1. Load remote host configuration
-			hostConfig, err := sshx.Load(command)
+			hostConfig, deployConfig, err := loadConfig(command)
 			if err != nil {
 				return err
 			}
 			// 2. all is used to store information of all hosts corresponding to each remote path
 			all := make(map[string][]HostFileInfo)
 			// 3. Iterate through all hosts
-			for _, config := range hostConfig {
-				// 3.1 Open SSH connection
-				sshClient, err := sshx.Open(config)
+			var mu sync.Mutex
+			results := runHosts(hostConfig, deployConfig.Parallel, func(host *depx.Host) error {
+				sftpClient, err := sshx.OpenSftp(host.Client)
 				if err != nil {
-					logx.Warn("[%s] Failed to open SSH connection: %v", config.Host, err)
-					continue
-				}
-				defer sshClient.Close()
-				sftpClient, err := sshx.OpenSftp(sshClient)
-				if err != nil {
-					logx.Warn("[%s] create sftp client: %v", config.Host, err)
-					continue
+					return fmt.Errorf("create sftp client: %v", err)
 				}
 				defer sftpClient.Close()
-				// 3.2 List remote directory file information
-				// Parameters read from CLI command FlagRemoteRepo and FlagCurrentLink
-				list, err := sshx.List(sftpClient, command.String(flagx.FlagRemoteRepo), command.String(flagx.FlagCurrentLink))
+				// 3.1 List remote directory file information
+				// Parameters read from CLI command FlagRemoteRepo and FlagCurrentLink, or the project file
+				list, err := sshx.List(sftpClient, deployConfig.GetRemoteRepo(), deployConfig.GetCurrentLink())
 				if err != nil {
-					logx.Warn("[%s] list failed: %v", config.Host, err)
-					continue
+					return fmt.Errorf("list failed: %v", err)
 				}
-				// 3.3 Add each file information to the all map
+				// 3.2 Read the manifest of every release, releases without one are shown from their mtime
+				infos := make([]HostFileInfo, 0, len(list))
 				for _, fi := range list {
-					all[fi.Path] = append(all[fi.Path], HostFileInfo{
-						Host: config.Host,
-						File: fi,
+					manifest, err := depx.ReadManifest(sftpClient, fi.Path)
+					if err != nil {
+						host.Log.Warn("read manifest of %s: %v", fi.Path, err)
+					}
+					infos = append(infos, HostFileInfo{
+						Host:     host.Name,
+						File:     fi,
+						Manifest: manifest,
 					})
 				}
-			}
+				// 3.3 Add each file information to the all map
+				mu.Lock()
+				defer mu.Unlock()
+				for _, info := range infos {
+					all[info.File.Path] = append(all[info.File.Path], info)
+				}
+				return nil
+			})
 
 			// 4. Find versions that exist on all hosts
 			var common []HostFileInfo
-			successHosts := len(hostConfig)
+			successHosts := len(hostConfig) - failedHosts(results)
 			for _, infos := range all {
 				// If a path has records on all hosts, it is considered common
 				if len(infos) == successHosts {
@@ -70,31 +78,46 @@ func History() *cli.Command {
 			// 5. Print table display
 			printTable(common)
 
-			return nil
+			// 6. Report unreachable hosts and fail when more hosts failed than --allow-partial
+			if failedHosts(results) > 0 {
+				printSummary(results)
+			}
+			return checkResults(results, deployConfig.AllowPartial)
 		},
 	}
 }
 
 // printTable outputs deployment history information in table format
 func printTable(list []HostFileInfo) {
-	// 1. Sort by file modification time in descending order, newest version at top
+	// 1. Sort by deployment time in descending order, newest version at top
 	sort.Slice(list, func(i, j int) bool {
-		return list[i].File.FileInfo.ModTime().
-			After(list[j].File.FileInfo.ModTime())
+		return list[i].Time().After(list[j].Time())
 	})
 
 	// 2. Create table object
 	tbl := utilx.NewTable()
-	tbl.AddHeader("Host", "Path", "version", "Current", "ModTime")
+	tbl.AddHeader("Host", "Version", "Current", "Time", "User", "From", "Commit", "Branch", "Files", "Size", "Checksum")
 
 	// 3. Iterate through list and add each record to the table
 	for _, fi := range list {
+		var user, from, commit, branch, files, size, checksum string
+		if m := fi.Manifest; m != nil {
+			user, from = m.User, m.Hostname
+			files, size = strconv.Itoa(m.Files), utilx.FormatBytes(m.Size)
+			checksum = shorten(m.Checksum, 12)
+			if m.Git != nil {
+				commit, branch = shorten(m.Git.Commit, 8), m.Git.Branch
+				if m.Git.Dirty {
+					commit += "-dirty"
+				}
+			}
+		}
 		tbl.AddLine(
-			fi.Host,                            // Host name
-			fi.File.Path,                       // File path
-			fi.File.Name,                       // File name or version name
-			strconv.FormatBool(fi.File.IsLink), // Whether it is a soft link
-			fi.File.FileInfo.ModTime().Format("2006-01-02 15:04:05"), // Modification time
+			fi.Host,                                 // Host name
+			fi.File.Name,                            // File name or version name
+			strconv.FormatBool(fi.File.IsLink),      // Whether it is a soft link
+			fi.Time().Format("2006-01-02 15:04:05"), // Deployment time, modification time without a manifest
+			user, from, commit, branch, files, size, checksum,
 		)
 	}
 
@@ -102,8 +125,25 @@ func printTable(list []HostFileInfo) {
 	tbl.Print()
 }
 
+// shorten cuts s to n characters
+func shorten(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
 // HostFileInfo contains host name and remote file information
 type HostFileInfo struct {
-	Host string
-	File sshx.FileInfo
+	Host     string
+	File     sshx.FileInfo
+	Manifest *depx.Manifest // Release manifest, nil for releases deployed without one
+}
+
+// Time returns when the release was deployed, falling back to its modification time
+func (h HostFileInfo) Time() time.Time {
+	if h.Manifest != nil {
+		return h.Manifest.Time
+	}
+	return h.File.FileInfo.ModTime()
 }
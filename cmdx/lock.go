@@ -0,0 +1,67 @@
+package cmdx
+
+import (
+	"chihqiang/depctl/depx"
+	"chihqiang/depctl/flagx"
+	"context"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Lock returns a CLI command for locking remote hosts against deployments
+// The lock is kept until depctl unlock, it never becomes stale
+func Lock() *cli.Command {
+	return &cli.Command{
+		Name:      "lock",
+		Usage:     "Freeze deployments until you unlock",
+		ArgsUsage: "[stage]",
+		Action: func(ctx context.Context, command *cli.Command) error {
+			// 1. Load remote host configuration and deployment configuration
+			hostConfig, deployConfig, err := loadConfig(command)
+			if err != nil {
+				return err
+			}
+
+			// 2. Take the deploy lock on every host and keep it
+			lock := depx.NewLock(depx.LockCommand)
+			results := runHosts(hostConfig, deployConfig.Parallel, func(host *depx.Host) error {
+				if err := depx.AcquireLock(host, deployConfig, lock); err != nil {
+					return err
+				}
+				host.Log.Info("Locked")
+				return nil
+			})
+
+			// 3. All hosts processing completed, fail when more hosts failed than --allow-partial
+			printSummary(results)
+			return checkResults(results, deployConfig.AllowPartial)
+		},
+	}
+}
+
+// Unlock returns a CLI command for removing the deploy lock of remote hosts
+func Unlock() *cli.Command {
+	return &cli.Command{
+		Name:      "unlock",
+		Usage:     "Let deployments flow again",
+		ArgsUsage: "[stage]",
+		Flags:     flagx.UnlockFlags(),
+		Action: func(ctx context.Context, command *cli.Command) error {
+			// 1. Load remote host configuration and deployment configuration
+			hostConfig, deployConfig, err := loadConfig(command)
+			if err != nil {
+				return err
+			}
+
+			// 2. Remove the deploy lock on every host, locks of others only with --force
+			force := command.Bool(flagx.FlagForce)
+			results := runHosts(hostConfig, deployConfig.Parallel, func(host *depx.Host) error {
+				return depx.Unlock(host, deployConfig, force)
+			})
+
+			// 3. All hosts processing completed, fail when more hosts failed than --allow-partial
+			printSummary(results)
+			return checkResults(results, deployConfig.AllowPartial)
+		},
+	}
+}
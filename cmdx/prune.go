@@ -0,0 +1,58 @@
+package cmdx
+
+import (
+	"chihqiang/depctl/depx"
+	"chihqiang/depctl/flagx"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Prune returns a CLI command for removing old releases on remote hosts
+func Prune() *cli.Command {
+	return &cli.Command{
+		Name:      "prune",
+		Usage:     "Sweep out releases you no longer need",
+		ArgsUsage: "[stage]",
+		Flags:     flagx.PruneFlags(),
+		Action: func(ctx context.Context, command *cli.Command) error {
+			// 1. Load remote host configuration and deployment configuration
+			hostConfig, deployConfig, err := loadConfig(command)
+			if err != nil {
+				return err
+			}
+			opts := depx.PruneOptions{
+				Keep:      deployConfig.Keep,
+				OlderThan: command.Duration(flagx.FlagOlderThan),
+				DryRun:    command.Bool(flagx.FlagDryRun),
+			}
+			// Refuse to remove every old release by accident
+			if opts.Keep <= 0 && opts.OlderThan <= 0 {
+				return errors.New("nothing to prune, use --keep or --older-than")
+			}
+
+			// 2. Remove old releases on every host, holding the deploy lock of each
+			// With --dry-run hosts are not locked and only what would be removed is shown
+			run := func(host *depx.Host) error {
+				removed, err := depx.PruneReleases(host, deployConfig, opts)
+				if err != nil {
+					return fmt.Errorf("prune failed: %v", err)
+				}
+				if len(removed) == 0 {
+					host.Log.Info("Nothing to prune")
+				}
+				return nil
+			}
+			if !opts.DryRun {
+				run = withLock(deployConfig, depx.NewLock(command.Name), run)
+			}
+			results := runHosts(hostConfig, deployConfig.Parallel, run)
+
+			// 3. All hosts processing completed, fail when more hosts failed than --allow-partial
+			printSummary(results)
+			return checkResults(results, deployConfig.AllowPartial)
+		},
+	}
+}
@@ -4,61 +4,205 @@ import (
 	"chihqiang/depctl/depx"
 	"chihqiang/depctl/flagx"
 	"chihqiang/depctl/sshx"
+	"chihqiang/depctl/utilx"
 	"context"
 	"fmt"
-	"os"
+	"time"
 
-	"github.com/chihqiang/logx"
 	"github.com/urfave/cli/v3"
 )
 
 func Publish() *cli.Command {
 	return &cli.Command{
-		Name:  "publish",
-		Usage: "Fire up your app remotely",
-		Flags: append(flagx.PublishFlags(), flagx.VersionFlags()...),
+		Name:      "publish",
+		Usage:     "Fire up your app remotely",
+		ArgsUsage: "[stage]",
+		Flags:     append(flagx.PublishFlags(), flagx.VersionFlags()...),
 		Action: func(ctx context.Context, command *cli.Command) error {
-			// 1. Load remote host configuration
-			// Returns a slice, each element contains host, port, user, key and other information
-			hostConfig, err := sshx.Load(command)
+			// 1. Load remote host and deployment configuration
+			hostConfig, deployConfig, err := loadConfig(command)
 			if err != nil {
-				return fmt.Errorf("failed to load host config: %v", err)
+				return err
+			}
+			if deployConfig.Version == "" {
+				deployConfig.Version = depx.DefaultVersion(deployConfig)
 			}
 
-			// 2. Load deployment configuration
-			// deploy.Load reads yaml or command line parameters and returns deploy.Config
-			deployConfig := depx.Load(command)
+			// 2. With --dry-run only show the plan of every host
+			if command.Bool(flagx.FlagDryRun) {
+				return publishDryRun(hostConfig, deployConfig)
+			}
 
-			// 3. Pack local directory as tar.gz file
-			// Returns the temporary file path after packing
-			localTarGz, err := depx.PackDir(deployConfig)
+			// 3. Pack local directory as tar.gz file, or open the pre-built --artifact
+			// A single host gets the archive streamed straight into its tar, several hosts share a packed file
+			artifact, err := newArtifact(deployConfig, len(hostConfig))
 			if err != nil {
-				return fmt.Errorf("failed to pack directory: %v", err)
+				return fmt.Errorf("failed to prepare artifact: %v", err)
 			}
 			// Delete temporary file after deployment to avoid occupying space
-			defer func() {
-				_ = os.Remove(localTarGz)
-			}()
+			defer artifact.Cleanup()
 
-			// 4. Iterate through all hosts and execute deployment sequentially
-			for _, config := range hostConfig {
-				// Open SSH connection
-				sshClient, err := sshx.Open(config)
-				if err != nil {
-					logx.Warn("[%s] Failed to open SSH connection: %v", config.Host, err)
-					continue // Current host failed, continue to next host
-				}
-				// Ensure connection is closed to avoid resource leakage
-				defer sshClient.Close()
-				// 5. Execute deployment
-				// Including uploading archive, extracting, executing hooks, updating currentLink
-				if err := depx.PostDeployHost(sshClient, localTarGz, deployConfig); err != nil {
-					logx.Warn("[%s] Deploy failed: %v", config.Host, err)
-					continue // Current host failed, continue to next host
+			// 4. Iterate through all hosts and execute deployment, --parallel hosts at a time
+			// Every host is locked while it is deployed so concurrent runs cannot interleave
+			lock := depx.NewLock(command.Name)
+			var results []hostResult
+			if deployConfig.TwoPhase {
+				results = publishTwoPhase(hostConfig, artifact, deployConfig, lock)
+			} else {
+				results = runHosts(hostConfig, deployConfig.Parallel, withLock(deployConfig, lock, func(host *depx.Host) error {
+					// 5. Execute deployment
+					// Including uploading archive, extracting, executing hooks, updating currentLink
+					if err := depx.PostDeployHost(host, artifact, deployConfig); err != nil {
+						return fmt.Errorf("deploy failed: %v", err)
+					}
+					return nil
+				}))
+			}
+			// 6. All hosts deployment completed, fail when more hosts failed than --allow-partial
+			printSummary(results)
+			if artifact.Checksum != "" {
+				fmt.Printf("Artifact SHA-256: %s\n", artifact.Checksum)
+			}
+			return checkResults(results, deployConfig.AllowPartial)
+		},
+	}
+}
+
+// newArtifact streams the archive to a single host, and packs it into a temporary file
+// only when several hosts need the same bytes; with --delta every host gets its own stream
+func newArtifact(deployConfig *depx.Config, hosts int) (*depx.Artifact, error) {
+	if hosts == 1 || deployConfig.Delta {
+		return depx.NewArtifact(deployConfig)
+	}
+	return depx.PackDir(deployConfig)
+}
+
+// publishDryRun lists the files that would be packed or are in --artifact and checks every host,
+// printing what the deployment would change without changing anything
+func publishDryRun(hostConfig []*sshx.Config, deployConfig *depx.Config) error {
+	if err := deployConfig.Validate(); err != nil {
+		return err
+	}
+	artifact, err := depx.NewArtifact(deployConfig)
+	if err != nil {
+		return err
+	}
+	defer artifact.Cleanup()
+	source := deployConfig.Dir
+	if deployConfig.Artifact != "" {
+		source = deployConfig.Artifact
+	} else if deployConfig.GitRef != "" {
+		source = fmt.Sprintf("%s at %s", deployConfig.Dir, deployConfig.GitRef)
+	}
+	files, size := artifact.Entries(), artifact.Size
+	fmt.Printf("Files to upload from %s (%d entries, %s):\n", source, len(files), utilx.FormatBytes(size))
+	for _, f := range files {
+		fmt.Printf("  %s\n", f)
+	}
+
+	var all plans
+	results := runHosts(hostConfig, deployConfig.Parallel, func(host *depx.Host) error {
+		plan, err := depx.PlanPublish(host, artifact, deployConfig)
+		if err != nil {
+			return fmt.Errorf("plan failed: %v", err)
+		}
+		all.add(plan)
+		return nil
+	})
+	all.print(results)
+	printSummary(results)
+	return checkResults(results, deployConfig.AllowPartial)
+}
+
+// publishTwoPhase prepares the release on every host first, and only when all hosts
+// are prepared switches currentLink on all of them together
+// If preparation fails anywhere, the prepared releases are removed and no host switches
+func publishTwoPhase(hostConfig []*sshx.Config, artifact *depx.Artifact, deployConfig *depx.Config, lock *depx.Lock) []hostResult {
+	results := make([]hostResult, len(hostConfig))
+	hosts := make([]*depx.Host, len(hostConfig))
+	locked := make([]bool, len(hostConfig))
+	defer func() {
+		for i, host := range hosts {
+			if host == nil {
+				continue
+			}
+			if locked[i] {
+				if err := depx.ReleaseLock(host, deployConfig, lock); err != nil {
+					host.Log.Warn("release lock: %v", err)
 				}
 			}
-			// 6. All hosts deployment completed
+			_ = host.Client.Close()
+		}
+	}()
+	// timed runs fn for every connected host and records its failure and duration
+	timed := func(parallel int, fn func(host *depx.Host) error) {
+		forEach(len(hosts), parallel, func(i int) {
+			if results[i].Err != nil {
+				return
+			}
+			start := time.Now()
+			if err := fn(hosts[i]); err != nil {
+				hosts[i].Log.Warn("%v", err)
+				results[i].Err = err
+			}
+			results[i].Duration += time.Since(start)
+		})
+	}
+
+	// 1. Connect to every host
+	forEach(len(hostConfig), deployConfig.Parallel, func(i int) {
+		start := time.Now()
+		results[i].Host = hostConfig[i].Name()
+		hosts[i], results[i].Err = openHost(hostConfig[i], deployConfig.Parallel > 1)
+		results[i].Duration = time.Since(start)
+	})
+
+	// 2. Lock every host, the lock is held across both phases
+	forEach(len(hosts), deployConfig.Parallel, func(i int) {
+		if results[i].Err != nil {
+			return
+		}
+		if err := depx.AcquireLock(hosts[i], deployConfig, lock); err != nil {
+			hosts[i].Log.Warn("%v", err)
+			results[i].Err = err
+			return
+		}
+		locked[i] = true
+	})
+
+	// 3. Upload, extract and run the pre-hook everywhere, unless a host could not be locked
+	if failedHosts(results) == 0 {
+		timed(deployConfig.Parallel, func(host *depx.Host) error {
+			if err := depx.PrepareHost(host, artifact, deployConfig); err != nil {
+				return fmt.Errorf("prepare failed: %v", err)
+			}
 			return nil
-		},
+		})
+	}
+
+	// 4. Abort when any host could not be locked or prepared, removing every release created on the way
+	if failed := failedHosts(results); failed > 0 {
+		aborted := fmt.Errorf("aborted: %d of %d hosts could not be prepared", failed, len(results))
+		forEach(len(hosts), deployConfig.Parallel, func(i int) {
+			if hosts[i] == nil {
+				return
+			}
+			if err := depx.DiscardHost(hosts[i], deployConfig); err != nil {
+				hosts[i].Log.Warn("%v", err)
+			}
+			if results[i].Err == nil {
+				results[i].Err = aborted
+			}
+		})
+		return results
 	}
+
+	// 5. Switch all hosts together
+	timed(len(hosts), func(host *depx.Host) error {
+		if err := depx.SwitchHost(host, deployConfig); err != nil {
+			return fmt.Errorf("switch failed: %v", err)
+		}
+		return nil
+	})
+	return results
 }
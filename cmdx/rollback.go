@@ -7,62 +7,89 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/chihqiang/logx"
 	"github.com/urfave/cli/v3"
 )
 
+// Rollback returns a CLI command for switching back to an earlier release
+// Without --version each host goes back to the release that was active before the current one
 func Rollback() *cli.Command {
 	return &cli.Command{
-		Name:  "rollback",
-		Usage: "Revert your app to a previous version",
-		Flags: flagx.VersionFlags(),
+		Name:      "rollback",
+		Usage:     "Revert your app to a previous version",
+		ArgsUsage: "[stage]",
+		Flags:     flagx.RollbackFlags(),
 		Action: func(ctx context.Context, command *cli.Command) error {
-			// 1. Load remote host configuration
+			// 1. Load remote host configuration and deployment configuration
 			// hostConfig is a slice containing information of all hosts to be deployed (Host, Port, User, Key, etc.)
-			hostConfig, err := sshx.Load(command)
+			// deployConfig contains version number, directory, hook commands and other information
+			hostConfig, deployConfig, err := loadConfig(command)
 			if err != nil {
-				return fmt.Errorf("failed to load host config: %v", err)
+				return err
+			}
+			steps := command.Int(flagx.FlagSteps)
+			if steps < 1 {
+				return fmt.Errorf("invalid --steps %d, must be at least 1", steps)
 			}
 
-			// 2. Load deployment configuration
-			// deployConfig contains version number, directory, hook commands and other information
-			deployConfig := depx.Load(command)
-
-			// 3. Iterate through all remote hosts to perform operations
-			for _, config := range hostConfig {
-				// 3.1 Open SSH connection
-				sshClient, err := sshx.Open(config)
-				if err != nil {
-					// Connection failed, only log and continue to next host
-					logx.Warn("[%s] Failed to open SSH connection: %v", config.Host, err)
-					continue
-				}
-				// Ensure connection is closed when function returns to avoid resource leakage
-				defer sshClient.Close()
-				sftpClient, err := sshx.OpenSftp(sshClient)
+			// 2. Iterate through all remote hosts to perform operations, holding the deploy lock of each
+			// With --dry-run hosts are not locked and only the plan is shown
+			dryRun := command.Bool(flagx.FlagDryRun)
+			var all plans
+			run := func(host *depx.Host) error {
+				sftpClient, err := sshx.OpenSftp(host.Client)
 				if err != nil {
-					logx.Warn("[%s] create sftp client: %v", config.Host, err)
-					continue
+					return fmt.Errorf("create sftp client: %v", err)
 				}
 				defer sftpClient.Close()
-				// 3.2 Check if remote version directory exists
+				// 2.1 Resolve the target release per host, hosts may have different deployment records
+				// Each host gets its own copy of the configuration since hosts run in parallel
+				config := *deployConfig
+				host.Previous, _ = sshx.ReadLink(sftpClient, config.GetCurrentLink())
+				if config.Version == "" {
+					records, err := depx.ReadRecords(sftpClient, &config)
+					if err != nil {
+						return err
+					}
+					release, err := depx.PreviousRelease(records, host.Previous, steps)
+					if err != nil {
+						return err
+					}
+					if config.Version, err = depx.RecordedVersion(&config, release); err != nil {
+						return err
+					}
+				}
+
+				// 2.2 Check if remote version directory exists
 				// If version directory does not exist, rollback is not possible
-				if !sshx.RemoteExists(sftpClient, deployConfig.GetVersionRemoteDir()) {
-					logx.Warn("[%s] version not found: %s", config.Host, deployConfig.GetVersionRemoteDir())
-					continue
+				if !sshx.RemoteExists(sftpClient, config.GetVersionRemoteDir()) {
+					return fmt.Errorf("version not found: %s", config.GetVersionRemoteDir())
 				}
+				if dryRun {
+					plan, err := depx.PlanRollback(host, &config)
+					if err != nil {
+						return fmt.Errorf("plan failed: %v", err)
+					}
+					all.add(plan)
+					return nil
+				}
+				host.Log.Info("Rolling back to %s", config.GetVersionRemoteDir())
 
-				// 3.3 Execute deployment hooks (pre/post hooks)
+				// 2.3 Execute deployment hooks (pre/post hooks) and record the rollback
 				// This can be understood as "rollback operation" or redirecting to specified version
-				if err := depx.ExecuteDeployHooks(sshClient, deployConfig); err != nil {
-					// Hook execution failure only logs, continue to next host
-					logx.Warn("[%s] rollback failed: %v", config.Host, err)
-					continue
+				if err := depx.RollbackHost(host, &config); err != nil {
+					return fmt.Errorf("rollback failed: %v", err)
 				}
+				return nil
+			}
+			if !dryRun {
+				run = withLock(deployConfig, depx.NewLock(command.Name), run)
 			}
+			results := runHosts(hostConfig, deployConfig.Parallel, run)
 
-			// 4. All hosts processing completed
-			return nil
+			// 3. All hosts processing completed, fail when more hosts failed than --allow-partial
+			all.print(results)
+			printSummary(results)
+			return checkResults(results, deployConfig.AllowPartial)
 
 		},
 	}
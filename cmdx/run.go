@@ -0,0 +1,200 @@
+package cmdx
+
+import (
+	"chihqiang/depctl/depx"
+	"chihqiang/depctl/sshx"
+	"chihqiang/depctl/utilx"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// loadConfig loads the remote hosts and the deployment configuration shared by all commands
+func loadConfig(command *cli.Command) ([]*sshx.Config, *depx.Config, error) {
+	// Returns a slice, each element contains host, port, user, key and other information
+	hostConfig, err := sshx.Load(command)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load host config: %v", err)
+	}
+	// depx.Load reads yaml or command line parameters and returns depx.Config
+	deployConfig, err := depx.Load(command)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load deploy config: %v", err)
+	}
+	// Reject an invalid --allow-partial before touching any host
+	if _, err := parseAllowPartial(deployConfig.AllowPartial, len(hostConfig)); err != nil {
+		return nil, nil, err
+	}
+	return hostConfig, deployConfig, nil
+}
+
+// hostResult is the outcome of running a command on one host
+type hostResult struct {
+	Host     string        // Host name
+	Err      error         // Failure, nil when the host succeeded
+	Duration time.Duration // Time spent on the host, including connecting
+}
+
+// runHosts connects to every host and runs fn, at most parallel hosts at a time
+// Failures are logged with the host name and do not stop the other hosts
+// Results are returned in the order of hostConfig
+func runHosts(hostConfig []*sshx.Config, parallel int, fn func(host *depx.Host) error) []hostResult {
+	results := make([]hostResult, len(hostConfig))
+	forEach(len(hostConfig), parallel, func(i int) {
+		start := time.Now()
+		results[i].Host = hostConfig[i].Name()
+		results[i].Err = runHost(hostConfig[i], parallel > 1, fn)
+		results[i].Duration = time.Since(start)
+	})
+	return results
+}
+
+// withLock wraps fn so it runs while holding the deploy lock of the host
+func withLock(deployConfig *depx.Config, lock *depx.Lock, fn func(host *depx.Host) error) func(host *depx.Host) error {
+	return func(host *depx.Host) error {
+		if err := depx.AcquireLock(host, deployConfig, lock); err != nil {
+			return err
+		}
+		defer func() {
+			if err := depx.ReleaseLock(host, deployConfig, lock); err != nil {
+				host.Log.Warn("release lock: %v", err)
+			}
+		}()
+		return fn(host)
+	}
+}
+
+// plans collects the dry-run plans of hosts running in parallel
+type plans struct {
+	mu    sync.Mutex
+	plans map[string]*depx.Plan
+}
+
+// add stores the plan of a host
+func (p *plans) add(plan *depx.Plan) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.plans == nil {
+		p.plans = make(map[string]*depx.Plan)
+	}
+	p.plans[plan.Host] = plan
+}
+
+// print outputs the plans in the order of the results
+func (p *plans) print(results []hostResult) {
+	for _, r := range results {
+		if plan := p.plans[r.Host]; plan != nil {
+			fmt.Print(plan)
+		}
+	}
+}
+
+// forEach calls fn for 0..n-1, at most parallel calls at a time, and waits for all of them
+func forEach(n, parallel int, fn func(i int)) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// runHost connects to a single host and runs fn
+func runHost(config *sshx.Config, parallel bool, fn func(host *depx.Host) error) error {
+	host, err := openHost(config, parallel)
+	if err != nil {
+		return err
+	}
+	// Ensure connection is closed to avoid resource leakage
+	defer host.Client.Close()
+	if err := fn(host); err != nil {
+		host.Log.Warn("%v", err)
+		return err
+	}
+	return nil
+}
+
+// openHost opens the SSH connection to a host
+func openHost(config *sshx.Config, parallel bool) (*depx.Host, error) {
+	sshClient, err := sshx.Open(config)
+	if err != nil {
+		depx.NewHostLogger(config.Name()).Warn("Failed to open SSH connection: %v", err)
+		return nil, fmt.Errorf("open SSH connection: %w", err)
+	}
+	return depx.NewHost(config.Name(), sshClient, parallel), nil
+}
+
+// failedHosts counts the hosts that failed
+func failedHosts(results []hostResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// printSummary outputs one line per host with its status, duration and error
+func printSummary(results []hostResult) {
+	tbl := utilx.NewTable()
+	tbl.AddHeader("Host", "Status", "Duration", "Error")
+	for _, r := range results {
+		status, errMsg := "ok", ""
+		if r.Err != nil {
+			status, errMsg = "failed", r.Err.Error()
+		}
+		tbl.AddLine(r.Host, status, r.Duration.Round(time.Millisecond), errMsg)
+	}
+	tbl.Print()
+}
+
+// checkResults returns an error when more hosts failed than --allow-partial tolerates
+func checkResults(results []hostResult, allowPartial string) error {
+	failed := failedHosts(results)
+	if failed == 0 {
+		return nil
+	}
+	allowed, err := parseAllowPartial(allowPartial, len(results))
+	if err != nil {
+		return err
+	}
+	if failed > allowed {
+		return fmt.Errorf("%d of %d hosts failed", failed, len(results))
+	}
+	return nil
+}
+
+// parseAllowPartial converts --allow-partial to a number of hosts
+// It is either a host count such as 2, or a percentage of all hosts such as 10%
+func parseAllowPartial(value string, total int) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p > 100 {
+			return 0, fmt.Errorf("invalid --allow-partial %q, use a host count or a percentage between 0%% and 100%%", value)
+		}
+		return int(float64(total) * p / 100), nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid --allow-partial %q, use a host count or a percentage between 0%% and 100%%", value)
+	}
+	return n, nil
+}
@@ -0,0 +1,385 @@
+package confx
+
+import (
+	"chihqiang/depctl/flagx"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chihqiang/logx"
+	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// FileNames are the project file names looked up in --dir, in order
+var FileNames = []string{"depctl.yaml", "depctl.yml"}
+
+// Settings holds the deployment settings that can be committed in depctl.yaml
+// Booleans and numbers are pointers, nil when not set, so a stage can also set them to false or 0
+type Settings struct {
+	Hosts            []Host         `yaml:"hosts"`            // List of remote hosts, format: user[:password]@host[:port]
+	Key              string         `yaml:"key"`              // Path to SSH private key
+	Passphrase       string         `yaml:"passphrase"`       // Passphrase for SSH private key
+	Timeout          *time.Duration `yaml:"timeout"`          // SSH connection timeout, for example 30s
+	Parallel         *int           `yaml:"parallel"`         // Number of hosts to deploy to at the same time
+	AllowPartial     string         `yaml:"allowPartial"`     // Number or percentage of hosts allowed to fail, for example 1 or 10%
+	LockTimeout      *time.Duration `yaml:"lockTimeout"`      // Age after which a deploy lock is considered stale, for example 1h
+	TwoPhase         *bool          `yaml:"twoPhase"`         // Prepare every host before switching currentLink on any of them
+	Keep             *int           `yaml:"keep"`             // Number of releases to keep after a successful deployment
+	KnownHosts       string         `yaml:"knownHosts"`       // known_hosts file used to verify host keys
+	HostKeyCheck     string         `yaml:"hostKeyCheck"`     // Host key checking mode: strict, accept-new or off
+	NoAgent          *bool          `yaml:"noAgent"`          // Do not use keys from ssh-agent
+	SSHConfig        string         `yaml:"sshConfig"`        // OpenSSH client config used to resolve host aliases
+	Jump             string         `yaml:"jump"`             // Jump hosts for every host, format: user@host[:port][,user@host[:port]]
+	JumpKey          string         `yaml:"jumpKey"`          // Path to SSH private key for the jump hosts
+	JumpPassword     string         `yaml:"jumpPassword"`     // Password for the jump hosts
+	JumpPassphrase   string         `yaml:"jumpPassphrase"`   // Passphrase for the jump hosts private key
+	Include          []string       `yaml:"include"`          // Gitignore-style patterns of files or directories to include
+	Exclude          []string       `yaml:"exclude"`          // Gitignore-style patterns of files or directories to exclude
+	RespectGitignore *bool          `yaml:"respectGitignore"` // Also exclude what .gitignore files ignore
+	Owner            string         `yaml:"owner"`            // Owner of the archived files: name, uid or name:uid, default is the local owner
+	Group            string         `yaml:"group"`            // Group of the archived files: name, gid or name:gid, default is the local group
+	Compression      string         `yaml:"compression"`      // Format the archive is compressed with: gzip, zstd, xz or none
+	CompressionLevel *int           `yaml:"compressionLevel"` // Compression level, 0 is the default of the format
+	Delta            *bool          `yaml:"delta"`            // Upload only files changed since the current release, hard-linking the rest
+	Reproducible     *bool          `yaml:"reproducible"`     // Pack byte-identical archives from identical trees
+	RemoteRepo       string         `yaml:"remoteRepo"`       // Directory for storing remote versions
+	CurrentLink      string         `yaml:"currentLink"`      // Current symbolic link path
+	HookPre          string         `yaml:"hookPre"`          // Hook command to execute before deployment
+	HookPost         string         `yaml:"hookPost"`         // Hook command to execute after deployment
+	SharedDirs       []string       `yaml:"sharedDirs"`       // Directories kept in shared/ and linked into every release
+	SharedFiles      []string       `yaml:"sharedFiles"`      // Files kept in shared/ and linked into every release
+	HealthChecks     []HealthCheck  `yaml:"healthChecks"`     // Checks run after switching, a failure rolls back to the previous release
+}
+
+// HealthCheck verifies the application after currentLink was switched
+// Exactly one of HTTP, TCP and Command is set. HTTP and TCP checks are made from the
+// remote host through the SSH connection, so 127.0.0.1 refers to the host itself
+type HealthCheck struct {
+	HTTP     string        `yaml:"http"`     // URL requested with GET, for example http://127.0.0.1:8080/health
+	Status   int           `yaml:"status"`   // Expected HTTP status, default 200
+	Body     string        `yaml:"body"`     // Text the HTTP response body must contain, optional
+	TCP      string        `yaml:"tcp"`      // Address that must accept connections, for example 127.0.0.1:9000
+	Command  string        `yaml:"command"`  // Remote command that must exit with status 0
+	Retries  int           `yaml:"retries"`  // Attempts before the check fails, default 3
+	Interval time.Duration `yaml:"interval"` // Delay between attempts, default 2s
+	Timeout  time.Duration `yaml:"timeout"`  // Timeout of each attempt, default 10s
+}
+
+// File is a parsed depctl.yaml project file
+type File struct {
+	Path     string              `yaml:"-"` // Location the file was read from, empty if none was found
+	Stage    string              `yaml:"-"` // Name of the selected stage, empty if none was selected
+	Settings `yaml:",inline"`    // Shared defaults inherited by every stage
+	Stages   map[string]Settings `yaml:"stages"` // Named stages, for example staging or production
+}
+
+// Load reads the project file given by --config, or discovers it in --dir
+// A missing file is only an error when it was requested explicitly
+// When a stage is selected its settings are merged over the shared defaults
+func Load(cmd *cli.Command) (*File, error) {
+	stage := StageName(cmd)
+	filename := cmd.String(flagx.FlagConfig)
+	if filename == "" {
+		filename = discover(cmd.String(flagx.FlagDir))
+		if filename == "" {
+			if stage != "" {
+				return nil, fmt.Errorf("stage %q selected but no %s found", stage, FileNames[0])
+			}
+			return &File{}, nil
+		}
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	file := &File{}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", filename, err)
+	}
+	file.Path = filename
+	if stage != "" {
+		if err := file.selectStage(stage); err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// StageName returns the stage selected with --stage or as the first command argument
+func StageName(cmd *cli.Command) string {
+	if stage := cmd.String(flagx.FlagStage); stage != "" {
+		return stage
+	}
+	return cmd.Args().First()
+}
+
+// selectStage merges the named stage over the shared defaults
+func (f *File) selectStage(name string) error {
+	stage, ok := f.Stages[name]
+	if !ok {
+		names := make([]string, 0, len(f.Stages))
+		for n := range f.Stages {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("stage %q is not defined in %s, available stages: %s", name, f.Path, strings.Join(names, ", "))
+	}
+	f.Stage = name
+	f.Settings.merge(stage)
+	return nil
+}
+
+// merge overrides s with every value set in o, including false and 0
+func (s *Settings) merge(o Settings) {
+	if len(o.Hosts) > 0 {
+		s.Hosts = o.Hosts
+	}
+	if o.Key != "" {
+		s.Key = o.Key
+	}
+	if o.Passphrase != "" {
+		s.Passphrase = o.Passphrase
+	}
+	if o.Timeout != nil {
+		s.Timeout = o.Timeout
+	}
+	if o.Parallel != nil {
+		s.Parallel = o.Parallel
+	}
+	if o.AllowPartial != "" {
+		s.AllowPartial = o.AllowPartial
+	}
+	if o.LockTimeout != nil {
+		s.LockTimeout = o.LockTimeout
+	}
+	if o.TwoPhase != nil {
+		s.TwoPhase = o.TwoPhase
+	}
+	if o.Keep != nil {
+		s.Keep = o.Keep
+	}
+	if o.KnownHosts != "" {
+		s.KnownHosts = o.KnownHosts
+	}
+	if o.HostKeyCheck != "" {
+		s.HostKeyCheck = o.HostKeyCheck
+	}
+	if o.NoAgent != nil {
+		s.NoAgent = o.NoAgent
+	}
+	if o.SSHConfig != "" {
+		s.SSHConfig = o.SSHConfig
+	}
+	if o.Jump != "" {
+		s.Jump = o.Jump
+	}
+	if o.JumpKey != "" {
+		s.JumpKey = o.JumpKey
+	}
+	if o.JumpPassword != "" {
+		s.JumpPassword = o.JumpPassword
+	}
+	if o.JumpPassphrase != "" {
+		s.JumpPassphrase = o.JumpPassphrase
+	}
+	if len(o.Include) > 0 {
+		s.Include = o.Include
+	}
+	if len(o.Exclude) > 0 {
+		s.Exclude = o.Exclude
+	}
+	if o.RespectGitignore != nil {
+		s.RespectGitignore = o.RespectGitignore
+	}
+	if o.Owner != "" {
+		s.Owner = o.Owner
+	}
+	if o.Group != "" {
+		s.Group = o.Group
+	}
+	if o.Compression != "" {
+		s.Compression = o.Compression
+	}
+	if o.CompressionLevel != nil {
+		s.CompressionLevel = o.CompressionLevel
+	}
+	if o.Delta != nil {
+		s.Delta = o.Delta
+	}
+	if o.Reproducible != nil {
+		s.Reproducible = o.Reproducible
+	}
+	if o.RemoteRepo != "" {
+		s.RemoteRepo = o.RemoteRepo
+	}
+	if o.CurrentLink != "" {
+		s.CurrentLink = o.CurrentLink
+	}
+	if o.HookPre != "" {
+		s.HookPre = o.HookPre
+	}
+	if o.HookPost != "" {
+		s.HookPost = o.HookPost
+	}
+	if len(o.SharedDirs) > 0 {
+		s.SharedDirs = o.SharedDirs
+	}
+	if len(o.SharedFiles) > 0 {
+		s.SharedFiles = o.SharedFiles
+	}
+	if len(o.HealthChecks) > 0 {
+		s.HealthChecks = o.HealthChecks
+	}
+}
+
+// discover looks for a project file in dir, falling back to the working directory
+func discover(dir string) string {
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	for _, name := range FileNames {
+		filename := filepath.Join(dir, name)
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return filename // Let Load report the real error
+		}
+	}
+	return ""
+}
+
+// String returns the flag value when it overrides the project file, see Overrides,
+// otherwise the file value, otherwise the flag default
+func String(cmd *cli.Command, name, value string) string {
+	if value == "" || Overrides(cmd, name) {
+		return cmd.String(name)
+	}
+	return value
+}
+
+// StringSlice works like String for slice flags
+func StringSlice(cmd *cli.Command, name string, value []string) []string {
+	if len(value) == 0 || Overrides(cmd, name) {
+		return cmd.StringSlice(name)
+	}
+	return value
+}
+
+// Bool works like String for boolean flags, value is nil when the file does not set it
+func Bool(cmd *cli.Command, name string, value *bool) bool {
+	if value == nil || Overrides(cmd, name) {
+		return cmd.Bool(name)
+	}
+	return *value
+}
+
+// Int works like Bool for integer flags
+func Int(cmd *cli.Command, name string, value *int) int {
+	if value == nil || Overrides(cmd, name) {
+		return cmd.Int(name)
+	}
+	return *value
+}
+
+// Duration works like Bool for duration flags
+func Duration(cmd *cli.Command, name string, value *time.Duration) time.Duration {
+	if value == nil || Overrides(cmd, name) {
+		return cmd.Duration(name)
+	}
+	return *value
+}
+
+// Overrides reports whether the flag takes precedence over the project file
+// A flag given on the command line always does; one set through its environment variable only when no
+// stage is selected, so a forgotten export cannot redirect the stage that was picked explicitly
+func Overrides(cmd *cli.Command, name string) bool {
+	if !cmd.IsSet(name) {
+		return false
+	}
+	if StageName(cmd) == "" || onCommandLine(cmd, name) {
+		return true
+	}
+	warnIgnored(cmd, name)
+	return false
+}
+
+// ignoredOnce warns about every ignored environment variable only once
+var ignoredOnce sync.Map
+
+// warnIgnored warns that the environment variable of a flag lost against the selected stage
+func warnIgnored(cmd *cli.Command, name string) {
+	if _, warned := ignoredOnce.LoadOrStore(name, true); warned {
+		return
+	}
+	env := "its environment variable"
+	if vars := envVars(cmd, name); len(vars) > 0 {
+		env = strings.Join(vars, ", ")
+	}
+	logx.Warn("%s is ignored for stage %q, which sets %s itself; use --%s to override the stage", env, StageName(cmd), name, name)
+}
+
+// lookupFlag finds the flag called name in cmd or the commands above it
+func lookupFlag(cmd *cli.Command, name string) cli.Flag {
+	for _, c := range cmd.Lineage() {
+		for _, f := range c.Flags {
+			for _, n := range f.Names() {
+				if n == name {
+					return f
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// envVars returns the environment variables of a flag that are set
+func envVars(cmd *cli.Command, name string) []string {
+	f, ok := lookupFlag(cmd, name).(interface{ GetEnvVars() []string })
+	if !ok {
+		return nil
+	}
+	var set []string
+	for _, env := range f.GetEnvVars() {
+		if _, ok := os.LookupEnv(env); ok {
+			set = append(set, env)
+		}
+	}
+	return set
+}
+
+// onCommandLine reports whether the flag, under any of its names, was given in the arguments
+// cli records flags from the command line and from the environment alike, so the arguments are scanned
+func onCommandLine(cmd *cli.Command, name string) bool {
+	names := []string{name}
+	if f := lookupFlag(cmd, name); f != nil {
+		names = f.Names()
+	}
+	return flagInArgs(os.Args[1:], names)
+}
+
+// flagInArgs reports whether any of names is given in args as -name, --name, -name=value or --name=value
+// Arguments not starting with a dash are positional arguments or flag values, whatever they spell
+func flagInArgs(args, names []string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		arg, _, _ = strings.Cut(arg, "=")
+		for _, n := range names {
+			if arg == n {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package confx
+
+import "testing"
+
+func TestFlagInArgs(t *testing.T) {
+	names := []string{"hosts", "H"}
+	tests := []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{"long flag", []string{"publish", "--hosts", "web1"}, true},
+		{"single dash", []string{"publish", "-hosts", "web1"}, true},
+		{"alias", []string{"publish", "-H", "web1"}, true},
+		{"long flag with value", []string{"publish", "--hosts=web1"}, true},
+		{"single dash with value", []string{"publish", "-hosts=web1"}, true},
+		{"not given", []string{"publish", "--keep", "3"}, false},
+		{"positional argument", []string{"publish", "hosts"}, false},
+		{"flag value", []string{"publish", "--hook-pre", "hosts"}, false},
+		{"value with equals sign", []string{"publish", "hosts=web1"}, false},
+		{"other flag with the name as value", []string{"publish", "--stage=hosts"}, false},
+		{"prefix of another flag", []string{"publish", "--hosts-file", "x"}, false},
+		{"after --", []string{"publish", "--", "--hosts", "web1"}, false},
+		{"no arguments", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := flagInArgs(tt.args, names); got != tt.want {
+				t.Errorf("flagInArgs(%q) = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package confx
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+// Host is a remote host entry in the project file
+// It is either a plain target string, or a mapping with per-host settings:
+//
+//	hosts:
+//	  - deploy@web1.example.com
+//	  - target: deploy@10.0.0.12
+//	    jump: ops@bastion.example.com:2222
+type Host struct {
+	Target string `yaml:"target"` // Remote host, format: user[:password]@host[:port]
+	Jump   string `yaml:"jump"`   // Jump hosts for this host only, format: user@host[:port][,user@host[:port]]
+}
+
+// UnmarshalYAML accepts both the string and the mapping form
+func (h *Host) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&h.Target)
+	}
+	type plain Host
+	return value.Decode((*plain)(h))
+}
@@ -0,0 +1,288 @@
+package depx
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"chihqiang/depctl/utilx"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Magic bytes the archive formats of --artifact start with
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zipMagic  = []byte("PK\x03\x04")
+	tarMagic  = []byte("ustar") // At offset 257 of an uncompressed tar
+)
+
+// sniffTar returns the compression of a tar archive starting with head, ok is false for anything else
+func sniffTar(head []byte) (c Compression, ok bool) {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return CompressionGzip, true
+	case bytes.HasPrefix(head, zstdMagic):
+		return CompressionZstd, true
+	case bytes.HasPrefix(head, xzMagic):
+		return CompressionXz, true
+	case len(head) >= 257+len(tarMagic) && bytes.Equal(head[257:257+len(tarMagic)], tarMagic):
+		return CompressionNone, true
+	}
+	return "", false
+}
+
+// openArtifact validates the pre-built archive of config.Artifact
+// A tar archive, compressed with gzip, zstd, xz or not at all, is uploaded as it is; a zip is repacked
+// in the --compression format when it is written, so hosts need no unzip
+func openArtifact(config *Config) (*Artifact, error) {
+	// 1. Detect the format from the content, not the file name
+	f, err := os.Open(config.Artifact)
+	if err != nil {
+		return nil, fmt.Errorf("open artifact: %w", err)
+	}
+	defer f.Close()
+	head, err := bufio.NewReader(f).Peek(257 + len(tarMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read artifact: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// 2. Check every entry before anything is uploaded
+	artifact := &Artifact{config: config}
+	var check entryCheck
+	if c, ok := sniffTar(head); ok {
+		hash := sha256.New()
+		if err := check.tar(io.TeeReader(f, hash), c, artifact); err != nil {
+			return nil, fmt.Errorf("artifact %s: %w", config.Artifact, err)
+		}
+		// Hash whatever follows the tar stream too, the checksum covers the uploaded file
+		if _, err := io.Copy(hash, f); err != nil {
+			return nil, err
+		}
+		artifact.Path = config.Artifact
+		artifact.Checksum = hex.EncodeToString(hash.Sum(nil))
+		artifact.Compression = c
+	} else if bytes.HasPrefix(head, zipMagic) {
+		if err := check.zip(config.Artifact, artifact); err != nil {
+			return nil, fmt.Errorf("artifact %s: %w", config.Artifact, err)
+		}
+		artifact.zip = config.Artifact
+		artifact.Compression = config.Compression
+	} else {
+		return nil, fmt.Errorf("artifact %s: not a tar or zip archive", config.Artifact)
+	}
+	artifact.Manifest = NewManifest(config, artifact)
+	return artifact, nil
+}
+
+// entryCheck rejects archive entries that would be extracted outside the release directory
+type entryCheck struct {
+	symlinks []string // Symlink entries seen so far, nothing may be extracted through them
+}
+
+// tar checks every entry of a tar stream compressed in format compression and counts its files
+func (c *entryCheck) tar(r io.Reader, compression Compression, artifact *Artifact) error {
+	dr, err := newDecompressor(r, compression)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := c.add(header.Name, header.Typeflag, header.Linkname)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		artifact.entries = append(artifact.entries, name)
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeLink {
+			artifact.Files++
+			artifact.Size += header.Size
+		}
+	}
+}
+
+// zip checks every entry of a zip archive and counts its files
+func (c *entryCheck) zip(filename string, artifact *Artifact) error {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, file := range zr.File {
+		typeflag, link, err := zipEntryType(file)
+		if err != nil {
+			return err
+		}
+		name, err := c.add(file.Name, typeflag, link)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		artifact.entries = append(artifact.entries, name)
+		if typeflag == tar.TypeReg {
+			artifact.Files++
+			artifact.Size += int64(file.UncompressedSize64)
+		}
+	}
+	return nil
+}
+
+// add checks one entry and returns its cleaned name, empty for the archive root itself
+func (c *entryCheck) add(name string, typeflag byte, linkname string) (string, error) {
+	clean, err := cleanEntryName(name)
+	if err != nil {
+		return "", err
+	}
+	if clean == "" {
+		return "", nil
+	}
+	if link := c.insideSymlink(clean); link != "" {
+		return "", fmt.Errorf("entry %q is inside symlink %q", name, link)
+	}
+	switch typeflag {
+	case tar.TypeSymlink:
+		c.symlinks = append(c.symlinks, clean)
+	case tar.TypeLink:
+		// A hard link resolves its target through symlinks too, so it could link a file outside the release
+		target, err := cleanEntryName(linkname)
+		if err != nil {
+			return "", fmt.Errorf("hard link %q: %w", name, err)
+		}
+		if link := c.insideSymlink(target); link != "" {
+			return "", fmt.Errorf("hard link %q points inside symlink %q", name, link)
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		return "", fmt.Errorf("entry %q is a device", name)
+	}
+	return clean, nil
+}
+
+// insideSymlink returns the symlink entry that name lies below, empty when there is none
+func (c *entryCheck) insideSymlink(name string) string {
+	for _, link := range c.symlinks {
+		if strings.HasPrefix(name, link+"/") {
+			return link
+		}
+	}
+	return ""
+}
+
+// cleanEntryName rejects absolute names and names climbing out with .., a leading ./ is dropped
+func cleanEntryName(name string) (string, error) {
+	slashed := strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(slashed, "/") || (len(slashed) > 1 && slashed[1] == ':') {
+		return "", fmt.Errorf("entry %q has an absolute path", name)
+	}
+	for _, seg := range strings.Split(slashed, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("entry %q leaves the release directory", name)
+		}
+	}
+	clean := path.Clean(slashed)
+	if clean == "." {
+		return "", nil
+	}
+	return clean, nil
+}
+
+// zipEntryType returns the tar type of a zip entry, and the target of a symlink
+func zipEntryType(file *zip.File) (byte, string, error) {
+	mode := file.Mode()
+	switch {
+	case mode.IsDir():
+		return tar.TypeDir, "", nil
+	case mode&os.ModeSymlink != 0:
+		rc, err := file.Open()
+		if err != nil {
+			return 0, "", err
+		}
+		defer rc.Close()
+		target, err := io.ReadAll(io.LimitReader(rc, 4096))
+		return tar.TypeSymlink, string(target), err
+	case mode&os.ModeDevice != 0:
+		return tar.TypeBlock, "", nil
+	case mode.IsRegular():
+		return tar.TypeReg, "", nil
+	}
+	return 0, "", fmt.Errorf("entry %q has unsupported type %s", file.Name, mode.Type())
+}
+
+// packZip writes the entries of the zip archive to the tar archive
+func (a *Artifact) packZip(tw *tar.Writer, prepare func(header *tar.Header), bar utilx.Progress) error {
+	zr, err := zip.OpenReader(a.zip)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	var written int64
+	for _, file := range zr.File {
+		typeflag, link, err := zipEntryType(file)
+		if err != nil {
+			return err
+		}
+		name, err := cleanEntryName(file.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		header := &tar.Header{
+			Typeflag: typeflag,
+			Name:     name,
+			Linkname: link,
+			Mode:     int64(file.Mode().Perm()),
+			ModTime:  file.Modified,
+			Format:   tar.FormatPAX,
+		}
+		if header.ModTime.IsZero() {
+			header.ModTime = time.Now()
+		}
+		if typeflag == tar.TypeReg {
+			header.Size = int64(file.UncompressedSize64)
+		}
+		prepare(header)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if typeflag != tar.TypeReg {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(tw, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("extract %s: %w", file.Name, err)
+		}
+		written += n
+		_ = bar.Set64(written)
+	}
+	return nil
+}
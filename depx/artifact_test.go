@@ -0,0 +1,135 @@
+package depx
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestCleanEntryName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "a.txt", want: "a.txt"},
+		{name: "./a.txt", want: "a.txt"},
+		{name: "dir/", want: "dir"},
+		{name: "dir//sub/./f", want: "dir/sub/f"},
+		{name: `dir\sub\f`, want: "dir/sub/f"},
+		{name: ".", want: ""},
+		{name: "./", want: ""},
+		{name: "/etc/passwd", wantErr: true},
+		{name: `\etc\passwd`, wantErr: true},
+		{name: `C:\Windows`, wantErr: true},
+		{name: "c:/windows", wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "../a", wantErr: true},
+		{name: "dir/../../a", wantErr: true},
+		{name: "dir/../a", wantErr: true},
+		{name: `dir\..\..\a`, wantErr: true},
+		{name: "..a/b", want: "..a/b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cleanEntryName(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("cleanEntryName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("cleanEntryName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntryCheckAdd(t *testing.T) {
+	type entry struct {
+		name     string
+		typeflag byte
+		linkname string
+	}
+	tests := []struct {
+		name    string
+		entries []entry
+		wantErr bool
+	}{
+		{
+			name:    "plain files and directories",
+			entries: []entry{{"dir/", tar.TypeDir, ""}, {"dir/a", tar.TypeReg, ""}, {"b", tar.TypeReg, ""}},
+		},
+		{
+			name:    "archive root",
+			entries: []entry{{"./", tar.TypeDir, ""}, {"./a", tar.TypeReg, ""}},
+		},
+		{
+			name:    "symlink pointing outside is kept as a link",
+			entries: []entry{{"etc", tar.TypeSymlink, "/etc"}},
+		},
+		{
+			name:    "entry below a symlink",
+			entries: []entry{{"etc", tar.TypeSymlink, "/etc"}, {"etc/passwd", tar.TypeReg, ""}},
+			wantErr: true,
+		},
+		{
+			name:    "entry below a symlink written with ./",
+			entries: []entry{{"./etc", tar.TypeSymlink, "/etc"}, {"./etc/cron.d/job", tar.TypeReg, ""}},
+			wantErr: true,
+		},
+		{
+			name:    "sibling with a symlink as name prefix",
+			entries: []entry{{"etc", tar.TypeSymlink, "/etc"}, {"etc2/a", tar.TypeReg, ""}},
+		},
+		{
+			name:    "hard link inside the archive",
+			entries: []entry{{"a", tar.TypeReg, ""}, {"b", tar.TypeLink, "a"}},
+		},
+		{
+			name:    "hard link leaving the archive",
+			entries: []entry{{"b", tar.TypeLink, "../outside"}},
+			wantErr: true,
+		},
+		{
+			name:    "hard link to an absolute path",
+			entries: []entry{{"b", tar.TypeLink, "/etc/passwd"}},
+			wantErr: true,
+		},
+		{
+			name:    "hard link through a symlink",
+			entries: []entry{{"s", tar.TypeSymlink, "/etc"}, {"h", tar.TypeLink, "s/passwd"}},
+			wantErr: true,
+		},
+		{
+			name:    "hard link to a symlink itself",
+			entries: []entry{{"s", tar.TypeSymlink, "target"}, {"h", tar.TypeLink, "s"}},
+		},
+		{
+			name:    "character device",
+			entries: []entry{{"null", tar.TypeChar, ""}},
+			wantErr: true,
+		},
+		{
+			name:    "block device",
+			entries: []entry{{"sda", tar.TypeBlock, ""}},
+			wantErr: true,
+		},
+		{
+			name:    "absolute entry",
+			entries: []entry{{"/etc/passwd", tar.TypeReg, ""}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var check entryCheck
+			var err error
+			for _, e := range tt.entries {
+				if _, err = check.add(e.name, e.typeflag, e.linkname); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("add error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package depx
+
+import (
+	"archive/tar"
+	"bytes"
+	"chihqiang/depctl/sshx"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is the format the tar archive is compressed with
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+	CompressionXz   Compression = "xz"
+	CompressionNone Compression = "none"
+)
+
+// xzDictCaps are the dictionary sizes of the xz presets 1 to 9
+var xzDictCaps = [...]int{1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// ParseCompression parses a compression name, empty is gzip
+// level 0 is the default level of the format, otherwise gzip takes 1-9, zstd 1-22 and xz 1-9
+func ParseCompression(name string, level int) (Compression, error) {
+	c := Compression(name)
+	if c == "" {
+		c = CompressionGzip
+	}
+	maxLevel := 0
+	switch c {
+	case CompressionGzip, CompressionXz:
+		maxLevel = 9
+	case CompressionZstd:
+		maxLevel = 22
+	case CompressionNone:
+	default:
+		return "", fmt.Errorf("unknown compression %q, use gzip, zstd, xz or none", name)
+	}
+	if level < 0 || level > maxLevel {
+		if maxLevel == 0 {
+			return "", fmt.Errorf("compression %s takes no level", c)
+		}
+		return "", fmt.Errorf("compression level %d of %s must be between 1 and %d", level, c, maxLevel)
+	}
+	return c, nil
+}
+
+// Ext returns the file extension of a tar archive in this format
+func (c Compression) Ext() string {
+	switch c {
+	case CompressionZstd:
+		return ".tar.zst"
+	case CompressionXz:
+		return ".tar.xz"
+	case CompressionNone:
+		return ".tar"
+	}
+	return ".tar.gz"
+}
+
+// tarExtract returns the remote tar command extracting an archive in this format
+func (c Compression) tarExtract() string {
+	switch c {
+	case CompressionZstd:
+		return "tar -x --zstd"
+	case CompressionXz:
+		return "tar -x -J"
+	case CompressionNone:
+		return "tar -x"
+	}
+	return "tar -x -z"
+}
+
+// newCompressor compresses everything written to w
+// Archives carry no name or time in their headers, so equal archives compress to equal bytes
+func newCompressor(w io.Writer, c Compression, level int) (io.WriteCloser, error) {
+	switch c {
+	case CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case CompressionXz:
+		config := xz.WriterConfig{}
+		if level > 0 {
+			config.DictCap = xzDictCaps[level-1]
+		}
+		return config.NewWriter(w)
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	gw.Name, gw.ModTime = "", time.Time{}
+	return gw, nil
+}
+
+// newDecompressor reads the tar stream of an archive compressed in format c
+func newDecompressor(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case CompressionXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	}
+	return gzip.NewReader(r)
+}
+
+// nopWriteCloser writes an uncompressed archive
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// checkRemoteTar makes sure tar on the host can extract archives in format c, before anything is uploaded
+// gzip and plain tar are taken for granted, zstd and xz are tried on an empty archive
+func checkRemoteTar(host *Host, c Compression) error {
+	if c != CompressionZstd && c != CompressionXz {
+		return nil
+	}
+	var empty bytes.Buffer
+	cw, err := newCompressor(&empty, c, 0)
+	if err != nil {
+		return err
+	}
+	if err := tar.NewWriter(cw).Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	tarCmd := strings.Replace(c.tarExtract(), "-x", "-t", 1) + " -f -"
+	output, err := sshx.CommandStdin(host.Client, tarCmd, func(w io.Writer) error {
+		_, err := w.Write(empty.Bytes())
+		return err
+	})
+	if err != nil {
+		if msg := strings.TrimSpace(output); msg != "" {
+			err = fmt.Errorf("%s", msg)
+		}
+		return fmt.Errorf("remote tar cannot extract %s archives: %v; install %s on the host or use --compression gzip", c, err, c)
+	}
+	return nil
+}
@@ -4,17 +4,36 @@ import (
 	"errors"
 	"path"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	Dir         string   `yaml:"dir"`         // Deployment root directory (local or remote path)
-	Version     string   `yaml:"version"`     // Deployment version number, for example v1.0.0 or 20260102153000
-	Include     []string `yaml:"include"`     // List of files or directories to include
-	Exclude     []string `yaml:"exclude"`     // List of files or directories to exclude
-	RemoteRepo  string   `yaml:"remoteRepo"`  // Directory for storing remote versions, for example /data/app/releases
-	CurrentLink string   `yaml:"currentLink"` // Current symbolic link path, for example /data/app/current
-	HookPre     string   `yaml:"hookPre"`     // Hook command to execute before deployment
-	HookPost    string   `yaml:"hookPost"`    // Hook command to execute after deployment
+	Dir              string        `yaml:"dir"`              // Deployment root directory (local or remote path)
+	Version          string        `yaml:"version"`          // Deployment version number, for example v1.0.0 or 20260102153000
+	Artifact         string        `yaml:"artifact"`         // Pre-built tar.gz or zip archive deployed instead of packing Dir
+	GitRef           string        `yaml:"gitRef"`           // Git tag, branch or commit packed instead of the working tree of Dir
+	AllowDirty       bool          `yaml:"allowDirty"`       // Pack a working tree with uncommitted changes
+	Include          []string      `yaml:"include"`          // Gitignore-style patterns of files or directories to include
+	Exclude          []string      `yaml:"exclude"`          // Gitignore-style patterns of files or directories to exclude
+	RespectGitignore bool          `yaml:"respectGitignore"` // Also exclude what .gitignore files ignore
+	Owner            string        `yaml:"owner"`            // Owner of the archived files: name, uid or name:uid, default is the local owner
+	Group            string        `yaml:"group"`            // Group of the archived files: name, gid or name:gid, default is the local group
+	Compression      Compression   `yaml:"compression"`      // Format the archive is compressed with: gzip, zstd, xz or none
+	CompressionLevel int           `yaml:"compressionLevel"` // Compression level, 0 is the default of the format
+	Delta            bool          `yaml:"delta"`            // Upload only files changed since the current release, hard-linking the rest
+	Reproducible     bool          `yaml:"reproducible"`     // Pack byte-identical archives from identical trees
+	RemoteRepo       string        `yaml:"remoteRepo"`       // Directory for storing remote versions, for example /data/app/releases
+	CurrentLink      string        `yaml:"currentLink"`      // Current symbolic link path, for example /data/app/current
+	HookPre          string        `yaml:"hookPre"`          // Hook command to execute before deployment
+	HookPost         string        `yaml:"hookPost"`         // Hook command to execute after deployment
+	Parallel         int           `yaml:"parallel"`         // Number of hosts to deploy to at the same time
+	AllowPartial     string        `yaml:"allowPartial"`     // Number or percentage of hosts allowed to fail, for example 1 or 10%
+	LockTimeout      time.Duration `yaml:"lockTimeout"`      // Age after which a deploy lock is considered stale, 0 never
+	TwoPhase         bool          `yaml:"twoPhase"`         // Prepare every host before switching currentLink on any of them
+	Keep             int           `yaml:"keep"`             // Number of releases to keep after a successful deployment, 0 keeps all
+	SharedDirs       []string      `yaml:"sharedDirs"`       // Directories kept in shared/ and linked into every release, for example storage
+	SharedFiles      []string      `yaml:"sharedFiles"`      // Files kept in shared/ and linked into every release, for example .env
+	HealthChecks     []HealthCheck `yaml:"healthChecks"`     // Checks run after switching, a failure rolls back to the previous release
 }
 
 // Validate validates configuration parameters
@@ -32,6 +51,30 @@ func (c *Config) Validate() error {
 	if c.Version == "" {
 		return errors.New("version must not be empty")
 	}
+	if _, err := ParseCompression(string(c.Compression), c.CompressionLevel); err != nil {
+		return err
+	}
+	if c.Artifact != "" && c.GitRef != "" {
+		return errors.New("artifact and gitRef cannot be used together")
+	}
+	if c.Artifact != "" && c.Delta {
+		return errors.New("artifact and delta cannot be used together")
+	}
+	for _, p := range append(append([]string{}, c.SharedDirs...), c.SharedFiles...) {
+		if err := validateSharedPath(p); err != nil {
+			return err
+		}
+	}
+	for _, owner := range []string{c.Owner, c.Group} {
+		if _, err := parseOwner(owner); err != nil {
+			return err
+		}
+	}
+	for _, check := range c.HealthChecks {
+		if err := check.Validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -49,12 +92,13 @@ func (c *Config) GetVersion() string {
 // GetRemoteRepo gets the directory path for storing remote versions
 // If the path does not start with /, it will be automatically added
 // For example remoteRepo = "data/app/releases" → "/data/app/releases"
+// The path is cleaned, so a trailing slash does not move shared/ and .depctl/ into it
 func (c *Config) GetRemoteRepo() string {
 	remoteRepo := c.RemoteRepo
 	if !strings.HasPrefix(remoteRepo, "/") {
 		remoteRepo = "/" + remoteRepo
 	}
-	return remoteRepo
+	return path.Clean(remoteRepo)
 }
 
 // GetCurrentLink gets the current symbolic link path
@@ -68,6 +112,29 @@ func (c *Config) GetCurrentLink() string {
 	return currentLink
 }
 
+// GetSharedDir gets the directory holding shared files next to remoteRepo
+// For example remoteRepo = "/data/app/releases" → "/data/app/shared"
+func (c *Config) GetSharedDir() string {
+	return path.Join(path.Dir(c.GetRemoteRepo()), "shared")
+}
+
+// GetRecordsFile gets the file recording every switch of currentLink next to remoteRepo
+// For example remoteRepo = "/data/app/releases" → "/data/app/.depctl/history.jsonl"
+func (c *Config) GetRecordsFile() string {
+	return path.Join(path.Dir(c.GetRemoteRepo()), ".depctl", "history.jsonl")
+}
+
+// GetLockFile gets the deploy lock file next to remoteRepo
+// For example remoteRepo = "/data/app/releases" → "/data/app/.depctl/lock"
+func (c *Config) GetLockFile() string {
+	return path.Join(path.Dir(c.GetRemoteRepo()), ".depctl", "lock")
+}
+
+// GetTakeoverFile gets the file guarding the takeover of a stale deploy lock, next to the lock file
+func (c *Config) GetTakeoverFile() string {
+	return c.GetLockFile() + ".takeover"
+}
+
 // GetHookPre gets the pre-deployment hook command
 func (c *Config) GetHookPre() string {
 	return c.HookPre
@@ -0,0 +1,238 @@
+package depx
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// FilesFile lists the regular files of a release deployed with --delta, the next delta deployment compares against it
+const FilesFile = ".depctl/files.json"
+
+// deltaLinkWorkers is the number of hard links requested from a host at the same time
+const deltaLinkWorkers = 16
+
+// FileSum describes one regular file of a release
+type FileSum struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	Mode   uint32 `json:"mode"`            // Permission bits
+	MTime  int64  `json:"mtime"`           // Modification time on the host, Unix seconds
+	Owner  string `json:"owner,omitempty"` // --owner the file was packed with, empty for the local owner
+	Group  string `json:"group,omitempty"` // --group the file was packed with, empty for the local group
+}
+
+// hashFiles computes the FileSum of every regular file among entries, relative to config.Dir
+func hashFiles(config *Config, entries []string) (map[string]FileSum, error) {
+	var epoch int64
+	if config.Reproducible {
+		t, err := sourceDateEpoch()
+		if err != nil {
+			return nil, err
+		}
+		epoch = t.Unix()
+	}
+	sums := make(map[string]FileSum)
+	for _, relPath := range entries {
+		filename := filepath.Join(config.Dir, relPath)
+		info, err := os.Lstat(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		sum, err := hashFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		// The tar writer rounds times to the second, the host therefore reports the rounded time
+		mtime := info.ModTime().Round(time.Second).Unix()
+		if config.Reproducible {
+			mtime = epoch
+		}
+		sums[filepath.ToSlash(relPath)] = FileSum{
+			SHA256: sum,
+			Size:   info.Size(),
+			Mode:   uint32(info.Mode().Perm()),
+			MTime:  mtime,
+			Owner:  config.Owner,
+			Group:  config.Group,
+		}
+	}
+	return sums, nil
+}
+
+// hashFile returns the hex encoded SHA-256 of a local file
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readFileSums reads FilesFile of releaseDir, nil when the release was not deployed with --delta
+func readFileSums(sftpClient *sftp.Client, releaseDir string) (map[string]FileSum, error) {
+	var sums map[string]FileSum
+	if ok, err := readJSON(sftpClient, path.Join(releaseDir, FilesFile), &sums); !ok {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// unchangedFiles returns the files of sums that the release current already holds, with their record there
+// A file is unchanged when its checksum, mode and --owner/--group match the record of current, and its size
+// and time on the host still match that record, so it was not modified after it was deployed; a hard link
+// shares the owner of the file in current, so a changed owner override needs a new copy
+func unchangedFiles(sftpClient *sftp.Client, current string, sums map[string]FileSum) (map[string]FileSum, error) {
+	// 1. Compare the local files with the record of the current release
+	recorded, err := readFileSums(sftpClient, current)
+	if err != nil || recorded == nil {
+		return nil, err
+	}
+	candidates := make(map[string]FileSum)
+	dirs := make(map[string]bool)
+	for rel, sum := range sums {
+		if old, ok := recorded[rel]; ok && old.SHA256 == sum.SHA256 && old.Mode == sum.Mode && old.Owner == sum.Owner && old.Group == sum.Group {
+			candidates[rel] = old
+			for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+				dirs[dir] = true
+			}
+		}
+	}
+
+	// 2. Check the files on the host, only walking directories holding candidates
+	unchanged := make(map[string]FileSum)
+	walker := sftpClient.Walk(current)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), current), "/")
+		info := walker.Stat()
+		if rel == "" {
+			continue
+		}
+		if info.IsDir() {
+			if !dirs[rel] {
+				walker.SkipDir()
+			}
+			continue
+		}
+		old, ok := candidates[rel]
+		if ok && info.Mode().IsRegular() && info.Size() == old.Size && info.ModTime().Unix() == old.MTime {
+			unchanged[rel] = old
+		}
+	}
+	return unchanged, nil
+}
+
+// linkUnchanged hard-links the unchanged files from the release current into releaseDir
+// It returns the files that were linked, files that could not be linked are left to the upload
+func linkUnchanged(sftpClient *sftp.Client, current, releaseDir string, unchanged map[string]FileSum) (map[string]FileSum, error) {
+	if _, ok := sftpClient.HasExtension("hardlink@openssh.com"); !ok {
+		return nil, fmt.Errorf("the sftp server does not support hard links")
+	}
+	// 1. Create the parent directories, the archive sets their modes later
+	files := make([]string, 0, len(unchanged))
+	dirs := make(map[string]bool)
+	for rel := range unchanged {
+		files = append(files, rel)
+		dirs[path.Dir(rel)] = true
+	}
+	sort.Strings(files)
+	for dir := range dirs {
+		if dir == "." {
+			continue
+		}
+		if err := sftpClient.MkdirAll(path.Join(releaseDir, dir)); err != nil {
+			return nil, fmt.Errorf("create %s: %w", path.Join(releaseDir, dir), err)
+		}
+	}
+
+	// 2. Link the files, a few requests at a time
+	linked := make(map[string]FileSum)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < deltaLinkWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range queue {
+				if err := sftpClient.Link(path.Join(current, rel), path.Join(releaseDir, rel)); err != nil {
+					continue
+				}
+				mu.Lock()
+				linked[rel] = unchanged[rel]
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, rel := range files {
+		queue <- rel
+	}
+	close(queue)
+	wg.Wait()
+	return linked, nil
+}
+
+// deltaArtifact prepares the upload of artifact to one host with --delta
+// Files unchanged since the current release are hard-linked into the new release, the returned
+// artifact only packs the rest; when nothing can be linked it packs everything
+func deltaArtifact(host *Host, sftpClient *sftp.Client, artifact *Artifact, config *Config) *Artifact {
+	if host.Previous == "" {
+		return artifact.without(nil)
+	}
+	unchanged, err := unchangedFiles(sftpClient, host.Previous, artifact.sums)
+	if err == nil && len(unchanged) > 0 {
+		unchanged, err = linkUnchanged(sftpClient, host.Previous, config.GetVersionRemoteDir(), unchanged)
+	}
+	if err != nil {
+		host.Log.Warn("delta upload unavailable, uploading every file: %v", err)
+		return artifact.without(nil)
+	}
+	if len(unchanged) > 0 {
+		host.Log.Info("Linked %d unchanged files from %s", len(unchanged), host.Previous)
+	}
+	return artifact.without(unchanged)
+}
+
+// without returns a copy of the artifact for one host that skips the linked files
+// The copy has its own manifest and file record, so hosts can pack it at the same time
+func (a *Artifact) without(linked map[string]FileSum) *Artifact {
+	c := *a
+	if a.Manifest != nil {
+		m := *a.Manifest
+		c.Manifest = &m
+	}
+	c.skip = make(map[string]bool, len(linked))
+	c.sums = make(map[string]FileSum, len(a.sums))
+	for rel, sum := range a.sums {
+		if old, ok := linked[rel]; ok {
+			// A linked file keeps the time it has on the host
+			sum.MTime = old.MTime
+			c.skip[rel] = true
+			c.Size -= sum.Size
+		}
+		c.sums[rel] = sum
+	}
+	c.linked = len(c.skip)
+	return &c
+}
@@ -4,20 +4,28 @@ import (
 	"chihqiang/depctl/sshx"
 	"fmt"
 	"github.com/pkg/sftp"
+	"io"
+	"os"
 	"path"
 	"path/filepath"
-
-	"github.com/chihqiang/logx"
-	"golang.org/x/crypto/ssh"
+	"strings"
 )
 
 // PostDeployHost executes deployment on remote server
-func PostDeployHost(sshClient *ssh.Client, localTarGz string, config *Config) error {
+func PostDeployHost(host *Host, artifact *Artifact, config *Config) error {
+	if err := PrepareHost(host, artifact, config); err != nil {
+		return err
+	}
+	return SwitchHost(host, config)
+}
+
+// PrepareHost uploads and extracts the release and runs the pre-hook, without switching currentLink
+func PrepareHost(host *Host, artifact *Artifact, config *Config) (err error) {
 	// Validate configuration parameters
 	if err := config.Validate(); err != nil {
 		return err
 	}
-	sftpClient, err := sshx.OpenSftp(sshClient)
+	sftpClient, err := sshx.OpenSftp(host.Client)
 	if err != nil {
 		return fmt.Errorf("create sftp client: %w", err)
 	}
@@ -26,6 +34,12 @@ func PostDeployHost(sshClient *ssh.Client, localTarGz string, config *Config) er
 	if err := preDeployChecks(sftpClient, config); err != nil {
 		return err
 	}
+	// Make sure the remote tar can extract the archive before anything is created
+	if err := checkRemoteTar(host, artifact.Compression); err != nil {
+		return err
+	}
+	// Remember the active release, it is protected from pruning
+	host.Previous, _ = sshx.ReadLink(sftpClient, config.GetCurrentLink())
 	// Ensure parent directory of currentLink exists
 	// path.Dir returns the parent directory of a path, for example /data/app/current → /data/app
 	baseLinkDir := path.Dir(config.GetCurrentLink())
@@ -37,62 +51,192 @@ func PostDeployHost(sshClient *ssh.Client, localTarGz string, config *Config) er
 	if err := sshx.Mkdir(sftpClient, config.GetVersionRemoteDir()); err != nil {
 		return fmt.Errorf("version directory creation failed %s: %w", config.GetVersionRemoteDir(), err)
 	}
+	// The version directory did not exist before, so a failure from here on removes it again
+	host.Release = config.GetVersionRemoteDir()
+	defer func() {
+		if err == nil {
+			return
+		}
+		if discardErr := DiscardHost(host, config); discardErr != nil {
+			host.Log.Warn("%v", discardErr)
+		}
+	}()
+	// With --delta, files unchanged since the current release are hard-linked instead of uploaded
+	if config.Delta {
+		artifact = deltaArtifact(host, sftpClient, artifact, config)
+	}
+	// Upload and extract the archive
+	if err := uploadArtifact(host, sftpClient, artifact, config); err != nil {
+		return err
+	}
+
+	// Describe the release in its manifest
+	if artifact.Manifest != nil {
+		if err := writeManifest(sftpClient, config.GetVersionRemoteDir(), artifact.Manifest); err != nil {
+			return fmt.Errorf("write release manifest: %w", err)
+		}
+	}
+	// Record the files of the release for the next delta deployment
+	if artifact.sums != nil {
+		if err := writeJSON(sftpClient, path.Join(config.GetVersionRemoteDir(), FilesFile), artifact.sums); err != nil {
+			return fmt.Errorf("write release files: %w", err)
+		}
+	}
+
+	// Link shared directories and files into the release
+	if err := linkShared(host, config); err != nil {
+		return err
+	}
+
+	// Pre-deployment hook
+	runHookPre(host, config)
+	return nil
+}
+
+// uploadArtifact extracts the archive into the version directory
+// A packed archive is uploaded and extracted, a streamed one is packed straight into a remote tar
+func uploadArtifact(host *Host, sftpClient *sftp.Client, artifact *Artifact, config *Config) error {
+	if artifact.Streamed() {
+		bar := host.NewProgress(artifact.Size, "Streaming")
+		// Use %q to automatically add quotes, preventing errors with spaces or special characters in paths
+		tarCmd := fmt.Sprintf("cd %q && %s -f -", config.GetVersionRemoteDir(), artifact.Compression.tarExtract())
+		output, err := sshx.CommandStdin(host.Client, tarCmd, func(w io.Writer) error {
+			return artifact.Pack(w, bar)
+		})
+		if err != nil {
+			return fmt.Errorf("streaming upload failed: %s: %w", strings.TrimSpace(output), err)
+		}
+		return nil
+	}
 	// Upload archive to remote version directory
-	remoteTar := path.Join(config.GetVersionRemoteDir(), filepath.Base(localTarGz))
-	if err := sshx.UploadFile(sftpClient, localTarGz, remoteTar); err != nil {
+	remoteTar := path.Join(config.GetVersionRemoteDir(), filepath.Base(artifact.Path))
+	stat, err := os.Stat(artifact.Path)
+	if err != nil {
+		return fmt.Errorf("stat archive: %w", err)
+	}
+	bar := host.NewProgress(stat.Size(), "Uploading")
+	if err := sshx.UploadFile(sftpClient, artifact.Path, remoteTar, bar); err != nil {
 		return fmt.Errorf("file upload failed : %w", err)
 	}
-	// Extract uploaded tar.gz file and delete archive
+	// Extract uploaded archive and delete it
 	// Use %q to automatically add quotes, preventing errors with spaces or special characters in paths
 	tarCmd := fmt.Sprintf(
-		"cd %q && tar xf %q && rm -f %q",
-		config.GetVersionRemoteDir(), // Enter version directory
-		remoteTar,                    // Extract remote archive
-		remoteTar,                    // Delete archive after extraction
+		"cd %q && %s -f %q && rm -f %q",
+		config.GetVersionRemoteDir(),      // Enter version directory
+		artifact.Compression.tarExtract(), // Extract remote archive in its format
+		remoteTar,                         // Remote archive
+		remoteTar,                         // Delete archive after extraction
 	)
-	if _, err := sshx.Command(sshClient, tarCmd); err != nil {
+	if _, err := sshx.Command(host.Client, tarCmd); err != nil {
 		return fmt.Errorf("decompression failed: %w", err)
 	}
+	return nil
+}
 
-	// Execute deployment hooks (pre-hook / post-hook) and update currentLink
-	if err := ExecuteDeployHooks(sshClient, config); err != nil {
+// SwitchHost points currentLink to the prepared release, runs the post-hook and verifies the link
+func SwitchHost(host *Host, config *Config) error {
+	// Update currentLink and execute the post-hook
+	if err := switchLink(host, config); err != nil {
 		return fmt.Errorf("hook deployment failed: %w", err)
 	}
+	runHookPost(host, config)
 
+	sftpClient, err := sshx.OpenSftp(host.Client)
+	if err != nil {
+		return fmt.Errorf("create sftp client: %w", err)
+	}
+	defer sftpClient.Close()
 	//Post-deployment verification (ensure currentLink correctly points to new version)
 	if err := postDeployVerification(sftpClient, config); err != nil {
 		return fmt.Errorf("post-deployment verification failed.: %w", err)
 	}
+	recordSwitch(host, config, RecordPublish, config.GetVersionRemoteDir())
+
+	// Health checks, currentLink is rolled back to the previous release when one fails
+	if err := checkHealth(host, config); err != nil {
+		return err
+	}
+
+	// Remove old releases beyond --keep, failure does not fail the deployment
+	if config.Keep > 0 {
+		if _, err := PruneReleases(host, config, PruneOptions{Keep: config.Keep, Previous: host.Previous}); err != nil {
+			host.Log.Warn("prune failed: %v", err)
+		}
+	}
 
 	return nil
 }
 
+// DiscardHost removes the release PrepareHost created, when it will not be switched to
+// Nothing is removed when PrepareHost did not get to create it, or it was removed already
+func DiscardHost(host *Host, config *Config) error {
+	if host.Release == "" {
+		return nil
+	}
+	if _, err := sshx.Command(host.Client, fmt.Sprintf("rm -rf %q", host.Release)); err != nil {
+		return fmt.Errorf("remove %s: %w", host.Release, err)
+	}
+	host.Release = ""
+	return nil
+}
+
+// RollbackHost switches currentLink back to the release of config.Version and records the rollback
+func RollbackHost(host *Host, config *Config) error {
+	if err := ExecuteDeployHooks(host, config); err != nil {
+		return err
+	}
+	recordSwitch(host, config, RecordRollback, config.GetVersionRemoteDir())
+	return nil
+}
+
 // ExecuteDeployHooks executes pre-hook / update currentLink / post-hook
-func ExecuteDeployHooks(sshClient *ssh.Client, config *Config) error {
-	// Pre-deployment hook
+func ExecuteDeployHooks(host *Host, config *Config) error {
+	runHookPre(host, config)
+	if err := switchLink(host, config); err != nil {
+		return err
+	}
+	runHookPost(host, config)
+	return nil
+}
+
+// runHookPre executes the pre-deployment hook in the version directory
+func runHookPre(host *Host, config *Config) {
 	if hookPre := config.GetHookPre(); hookPre != "" {
 		// cd to version directory to execute pre-hook
-		if _, err := sshx.Command(sshClient, fmt.Sprintf("cd %s && %s", config.GetVersionRemoteDir(), hookPre)); err != nil {
+		if _, err := sshx.Command(host.Client, fmt.Sprintf("cd %s && %s", config.GetVersionRemoteDir(), hookPre)); err != nil {
 			// Failure only warns, does not block deployment
-			logx.Warn("pre-hook failed: %v", err)
+			host.Log.Warn("pre-hook failed: %v", err)
 		}
 	}
+}
 
-	// Update currentLink to point to new version (atomic operation ln -sfn)
-	deployCmd := fmt.Sprintf("ln -sfn %s %s", config.GetVersionRemoteDir(), config.GetCurrentLink())
-	if _, err := sshx.Command(sshClient, deployCmd); err != nil {
+// switchLink updates currentLink to point to the version directory (atomic operation ln -sfn)
+func switchLink(host *Host, config *Config) error {
+	return switchLinkTo(host, config, config.GetVersionRemoteDir())
+}
+
+// switchLinkTo updates currentLink to point to releaseDir
+func switchLinkTo(host *Host, config *Config, releaseDir string) error {
+	deployCmd := fmt.Sprintf("ln -sfn %s %s", releaseDir, config.GetCurrentLink())
+	if _, err := sshx.Command(host.Client, deployCmd); err != nil {
 		return fmt.Errorf("deploy cmdx failed: %w", err)
 	}
+	return nil
+}
 
-	// Post-deployment hook
+// runHookPost executes the post-deployment hook in the version directory
+func runHookPost(host *Host, config *Config) {
+	runHookPostIn(host, config, config.GetVersionRemoteDir())
+}
+
+// runHookPostIn executes the post-deployment hook in releaseDir
+func runHookPostIn(host *Host, config *Config, releaseDir string) {
 	if hookPost := config.GetHookPost(); hookPost != "" {
-		if _, err := sshx.Command(sshClient, fmt.Sprintf("cd %s && %s", config.GetVersionRemoteDir(), hookPost)); err != nil {
+		if _, err := sshx.Command(host.Client, fmt.Sprintf("cd %s && %s", releaseDir, hookPost)); err != nil {
 			// Failure only warns, does not block deployment
-			logx.Warn("post-hook: %v", err)
+			host.Log.Warn("post-hook: %v", err)
 		}
 	}
-
-	return nil
 }
 
 // preDeployChecks executes pre-deployment checks
@@ -0,0 +1,180 @@
+package depx
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// git runs a git command in dir and returns its trimmed output
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), msg)
+		}
+		return "", fmt.Errorf("git %s: %w", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// inWorkTree reports whether dir is inside a git work tree
+func inWorkTree(dir string) bool {
+	out, err := git(dir, "rev-parse", "--is-inside-work-tree")
+	return err == nil && out == "true"
+}
+
+// DefaultVersion names a release after git describe of config.GitRef, or of the working tree
+// with a -dirty suffix when it has changes; outside a git work tree, and for a pre-built
+// artifact, it is the current time
+func DefaultVersion(config *Config) string {
+	if config.Artifact != "" {
+		return time.Now().Format("20060102150405")
+	}
+	args := []string{"describe", "--tags", "--always"}
+	if config.GitRef != "" {
+		args = append(args, config.GitRef)
+	} else {
+		args = append(args, "--dirty")
+	}
+	if version, err := git(config.Dir, args...); err == nil && version != "" {
+		// Tags such as release/1.0 must not create nested release directories
+		return strings.ReplaceAll(version, "/", "-")
+	}
+	return time.Now().Format("20060102150405")
+}
+
+// checkClean refuses to pack a git working tree with uncommitted or untracked files below dir
+// Directories outside a git work tree are always clean
+func checkClean(dir string) error {
+	if !inWorkTree(dir) {
+		return nil
+	}
+	status, err := gitStatus(dir)
+	if err != nil {
+		return err
+	}
+	if status == "" {
+		return nil
+	}
+	lines := strings.Split(status, "\n")
+	if len(lines) > 5 {
+		lines = append(lines[:5], fmt.Sprintf("... and %d more", len(lines)-5))
+	}
+	return fmt.Errorf("working tree %s has uncommitted changes, commit them, use --git-ref or --allow-dirty:\n%s", dir, strings.Join(lines, "\n"))
+}
+
+// gitStatus lists the uncommitted and untracked files below dir, the part of the work tree that is packed
+func gitStatus(dir string) (string, error) {
+	return git(dir, "status", "--porcelain", "--", ".")
+}
+
+// exportGitRef writes the committed tree of config.GitRef below config.Dir into a new temporary directory
+// The tree comes from git archive, so export-ignore attributes apply and file times are the commit time
+func exportGitRef(config *Config) (string, error) {
+	if !inWorkTree(config.Dir) {
+		return "", fmt.Errorf("--git-ref needs %s to be inside a git work tree", config.Dir)
+	}
+	if _, err := git(config.Dir, "rev-parse", "--verify", "--quiet", config.GitRef+"^{commit}"); err != nil {
+		return "", fmt.Errorf("unknown git ref %q", config.GitRef)
+	}
+	dir, err := os.MkdirTemp("", "depctl-git-*")
+	if err != nil {
+		return "", err
+	}
+
+	// 1. Run from config.Dir, git archive only exports that subdirectory
+	cmd := exec.Command("git", "-C", config.Dir, "archive", "--format=tar", config.GitRef)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", fmt.Errorf("git archive: %w", err)
+	}
+
+	// 2. Extract while git writes, draining the rest so git can exit on failure
+	extractErr := extractTar(stdout, dir)
+	_, _ = io.Copy(io.Discard, stdout)
+	waitErr := cmd.Wait()
+	if err := errors.Join(extractErr, waitErr); err != nil {
+		_ = os.RemoveAll(dir)
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git archive %s: %s", config.GitRef, msg)
+		}
+		return "", fmt.Errorf("git archive %s: %w", config.GitRef, err)
+	}
+	return dir, nil
+}
+
+// extractTar extracts directories, regular files and symlinks of a tar stream into dir
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := cleanEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeFile(target, tr, os.FileMode(header.Mode).Perm()); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeFile writes the content of r to a new file with the given mode
+func writeFile(filename string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,70 @@
+package depx
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// gitRepo creates a repository with a committed app/ directory and returns its root
+func gitRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	for _, f := range []string{"app/index.php", "docs/readme.md"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(f)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, f), []byte("v1\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+	} {
+		if _, err := git(root, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestDirtyStateBelowDir(t *testing.T) {
+	tests := []struct {
+		name      string
+		change    string
+		wantDirty bool
+	}{
+		{"clean", "", false},
+		{"change outside dir", "docs/readme.md", false},
+		{"untracked outside dir", "docs/new.md", false},
+		{"change inside dir", "app/index.php", true},
+		{"untracked inside dir", "app/new.php", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := gitRepo(t)
+			if tt.change != "" {
+				if err := os.WriteFile(filepath.Join(root, tt.change), []byte("v2\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dir := filepath.Join(root, "app")
+			if err := checkClean(dir); (err != nil) != tt.wantDirty {
+				t.Errorf("checkClean() error = %v, want dirty %v", err, tt.wantDirty)
+			}
+			info := readGitInfo(dir, "")
+			if info == nil {
+				t.Fatal("readGitInfo() = nil in a git work tree")
+			}
+			if info.Dirty != tt.wantDirty {
+				t.Errorf("readGitInfo().Dirty = %v, want %v", info.Dirty, tt.wantDirty)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package depx
+
+import "os"
+
+// fileID identifies a file across hard links
+type fileID struct{}
+
+// hardLinkID reports no hard links where the platform does not expose inode numbers
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
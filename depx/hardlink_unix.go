@@ -0,0 +1,23 @@
+//go:build unix
+
+package depx
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID identifies a file across hard links
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLinkID returns the identity of a file with more than one hard link
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
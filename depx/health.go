@@ -0,0 +1,161 @@
+package depx
+
+import (
+	"chihqiang/depctl/confx"
+	"chihqiang/depctl/sshx"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Health check defaults
+const (
+	DefaultHealthRetries  = 3
+	DefaultHealthInterval = 2 * time.Second
+	DefaultHealthTimeout  = 10 * time.Second
+)
+
+// HealthCheck verifies the application after currentLink was switched
+type HealthCheck confx.HealthCheck
+
+// String describes the check for log lines
+func (h HealthCheck) String() string {
+	switch {
+	case h.HTTP != "":
+		return "http " + h.HTTP
+	case h.TCP != "":
+		return "tcp " + h.TCP
+	default:
+		return "command " + h.Command
+	}
+}
+
+// Validate checks that exactly one kind of check is configured
+func (h HealthCheck) Validate() error {
+	kinds := 0
+	for _, v := range []string{h.HTTP, h.TCP, h.Command} {
+		if v != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("a health check needs exactly one of http, tcp or command")
+	}
+	return nil
+}
+
+// Run executes the check on the host, retrying until it passes or the retries are used up
+func (h HealthCheck) Run(host *Host) error {
+	retries := h.Retries
+	if retries <= 0 {
+		retries = DefaultHealthRetries
+	}
+	interval := h.Interval
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+	var err error
+	for attempt := 1; attempt <= retries; attempt++ {
+		if attempt > 1 {
+			time.Sleep(interval)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = h.attempt(ctx, host)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		host.Log.Warn("health check %s failed (attempt %d/%d): %v", h, attempt, retries, err)
+	}
+	return fmt.Errorf("health check %s: %w", h, err)
+}
+
+// attempt executes the check once
+func (h HealthCheck) attempt(ctx context.Context, host *Host) error {
+	switch {
+	case h.HTTP != "":
+		return h.checkHTTP(ctx, host)
+	case h.TCP != "":
+		conn, err := host.Client.DialContext(ctx, "tcp", h.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	default:
+		output, err := sshx.CommandContext(ctx, host.Client, h.Command)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(output))
+		}
+		return nil
+	}
+}
+
+// checkHTTP requests the URL through the SSH connection and compares status and body
+func (h HealthCheck) checkHTTP(ctx context.Context, host *Host) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return host.Client.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.HTTP, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	status := h.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if resp.StatusCode != status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, status)
+	}
+	if h.Body != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), h.Body) {
+			return fmt.Errorf("response body does not contain %q", h.Body)
+		}
+	}
+	return nil
+}
+
+// checkHealth runs every health check and rolls currentLink back to the
+// previously active release when one of them fails
+func checkHealth(host *Host, config *Config) error {
+	for _, check := range config.HealthChecks {
+		err := check.Run(host)
+		if err == nil {
+			continue
+		}
+		if host.Previous == "" {
+			return fmt.Errorf("%w, no previous release to roll back to", err)
+		}
+		host.Log.Warn("rolling back to %s", host.Previous)
+		if rollbackErr := switchLinkTo(host, config, host.Previous); rollbackErr != nil {
+			return fmt.Errorf("%w, rollback to %s failed: %v", err, host.Previous, rollbackErr)
+		}
+		recordSwitch(host, config, RecordRollback, host.Previous)
+		// Let the post-hook reload services for the restored release
+		runHookPostIn(host, config, host.Previous)
+		return fmt.Errorf("%w, rolled back to %s", err, host.Previous)
+	}
+	return nil
+}
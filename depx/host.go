@@ -0,0 +1,45 @@
+package depx
+
+import (
+	"chihqiang/depctl/utilx"
+	"os"
+
+	"github.com/chihqiang/logx"
+	"golang.org/x/crypto/ssh"
+)
+
+// Host is a connected remote host taking part in a deployment
+type Host struct {
+	Name     string       // Host name shown in log lines
+	Client   *ssh.Client  // SSH connection to the host
+	Log      logx.ILogger // Logger prefixed with the host name
+	Parallel bool         // Whether other hosts are deployed at the same time
+	Previous string       // Release currentLink pointed to before this deployment, empty on first deploy
+	Release  string       // Release directory this deployment created, empty once it was removed again
+}
+
+// NewHost wraps an SSH connection with a logger prefixed by the host name
+func NewHost(name string, client *ssh.Client, parallel bool) *Host {
+	return &Host{
+		Name:     name,
+		Client:   client,
+		Log:      NewHostLogger(name),
+		Parallel: parallel,
+	}
+}
+
+// NewHostLogger returns a logger whose lines are prefixed with the host name
+func NewHostLogger(name string) logx.ILogger {
+	logger := logx.New(os.Stderr)
+	logger.SetPrefix(name)
+	return logger
+}
+
+// NewProgress returns a progress bar for the host
+// When hosts run in parallel progress is logged per host instead of drawing a shared bar
+func (h *Host) NewProgress(totalSize int64, description string) utilx.Progress {
+	if h.Parallel {
+		return utilx.NewLogProgress(totalSize, description, h.Log)
+	}
+	return utilx.NewProgress(totalSize, description)
+}
@@ -0,0 +1,98 @@
+package depx
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ignore files read from every directory while packing
+const (
+	IgnoreFile    = ".depctlignore"
+	GitIgnoreFile = ".gitignore"
+)
+
+// ignoreTree holds the ignore files found while walking the directory to pack
+// Patterns in an ignore file are relative to the directory containing it, and files in deeper
+// directories take precedence over files above them, like .gitignore
+type ignoreTree struct {
+	root    string              // Directory being packed
+	names   []string            // Ignore file names read from every directory, later names take precedence
+	files   map[string]Patterns // Patterns per directory, relative to root with / separators, "" for root
+	exclude Patterns            // Patterns from --exclude, they take precedence over all files
+}
+
+// newIgnoreTree creates the ignore rules for packing config.Dir
+func newIgnoreTree(config *Config) (*ignoreTree, error) {
+	exclude, err := ParsePatterns(config.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %w", err)
+	}
+	t := &ignoreTree{
+		root:    config.Dir,
+		names:   []string{IgnoreFile},
+		files:   make(map[string]Patterns),
+		exclude: exclude,
+	}
+	if config.RespectGitignore {
+		// Git never packs its own directory
+		t.files[""] = Patterns{{source: ".git/", dirOnly: true, segments: []string{"**", ".git"}}}
+		t.names = []string{GitIgnoreFile, IgnoreFile}
+	}
+	return t, nil
+}
+
+// load reads the ignore files of the directory rel, called before its entries are walked
+func (t *ignoreTree) load(rel string) error {
+	for _, name := range t.names {
+		filename := filepath.Join(t.root, filepath.FromSlash(rel), name)
+		lines, err := readLines(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		ps, err := ParsePatterns(lines)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		t.files[rel] = append(t.files[rel], ps...)
+	}
+	return nil
+}
+
+// Ignored reports whether the path rel, relative to root with / separators, is excluded
+// Parent directories are not checked, an ignored directory is skipped with everything in it
+func (t *ignoreTree) Ignored(rel string, isDir bool) bool {
+	ignored := false
+	// Ignore files from the root down to the parent directory of rel, each matching relative to its directory
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		ps := t.files[strings.Join(parts[:i], "/")]
+		if matched, ok := ps.matchLast(strings.Join(parts[i:], "/"), isDir); ok {
+			ignored = matched
+		}
+	}
+	if matched, ok := t.exclude.matchLast(rel, isDir); ok {
+		ignored = matched
+	}
+	return ignored
+}
+
+// readLines reads a text file line by line
+func readLines(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
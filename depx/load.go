@@ -1,19 +1,80 @@
 package depx
 
 import (
+	"chihqiang/depctl/confx"
 	"chihqiang/depctl/flagx"
+	"strings"
+
 	"github.com/urfave/cli/v3"
 )
 
-func Load(cmd *cli.Command) *Config {
-	return &Config{
-		Dir:         cmd.String(flagx.FlagDir),
-		Version:     cmd.String(flagx.FlagVersion),
-		Include:     cmd.StringSlice(flagx.FlagInclude),
-		Exclude:     cmd.StringSlice(flagx.FlagExclude),
-		RemoteRepo:  cmd.String(flagx.FlagRemoteRepo),
-		CurrentLink: cmd.String(flagx.FlagCurrentLink),
-		HookPre:     cmd.String(flagx.FlagHookPre),
-		HookPost:    cmd.String(flagx.FlagHookPost),
+// Load builds the deployment configuration from command line flags,
+// falling back to depctl.yaml for anything not set on the command line
+func Load(cmd *cli.Command) (*Config, error) {
+	file, err := confx.Load(cmd)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{
+		Dir:              cmd.String(flagx.FlagDir),
+		Version:          cmd.String(flagx.FlagVersion),
+		Artifact:         cmd.String(flagx.FlagArtifact),
+		GitRef:           cmd.String(flagx.FlagGitRef),
+		AllowDirty:       cmd.Bool(flagx.FlagAllowDirty),
+		Include:          confx.StringSlice(cmd, flagx.FlagInclude, file.Include),
+		Exclude:          confx.StringSlice(cmd, flagx.FlagExclude, file.Exclude),
+		RespectGitignore: confx.Bool(cmd, flagx.FlagRespectGitignore, file.RespectGitignore),
+		Owner:            confx.String(cmd, flagx.FlagOwner, file.Owner),
+		Group:            confx.String(cmd, flagx.FlagGroup, file.Group),
+		Compression:      Compression(strings.ToLower(confx.String(cmd, flagx.FlagCompression, file.Compression))),
+		CompressionLevel: confx.Int(cmd, flagx.FlagCompressionLevel, file.CompressionLevel),
+		Delta:            confx.Bool(cmd, flagx.FlagDelta, file.Delta),
+		Reproducible:     confx.Bool(cmd, flagx.FlagReproducible, file.Reproducible),
+		RemoteRepo:       confx.String(cmd, flagx.FlagRemoteRepo, file.RemoteRepo),
+		CurrentLink:      confx.String(cmd, flagx.FlagCurrentLink, file.CurrentLink),
+		HookPre:          confx.String(cmd, flagx.FlagHookPre, file.HookPre),
+		HookPost:         confx.String(cmd, flagx.FlagHookPost, file.HookPost),
+		Parallel:         confx.Int(cmd, flagx.FlagParallel, file.Parallel),
+		AllowPartial:     confx.String(cmd, flagx.FlagAllowPartial, file.AllowPartial),
+		LockTimeout:      confx.Duration(cmd, flagx.FlagLockTimeout, file.LockTimeout),
+		TwoPhase:         confx.Bool(cmd, flagx.FlagTwoPhase, file.TwoPhase),
+		Keep:             confx.Int(cmd, flagx.FlagKeep, file.Keep),
+		SharedDirs:       confx.StringSlice(cmd, flagx.FlagSharedDir, file.SharedDirs),
+		SharedFiles:      confx.StringSlice(cmd, flagx.FlagSharedFile, file.SharedFiles),
+	}
+	// --health-retries and --health-timeout fill in what a check of the project file leaves unset
+	for _, check := range file.HealthChecks {
+		if check.Retries == 0 {
+			check.Retries = cmd.Int(flagx.FlagHealthRetries)
+		}
+		if check.Timeout == 0 {
+			check.Timeout = cmd.Duration(flagx.FlagHealthTimeout)
+		}
+		config.HealthChecks = append(config.HealthChecks, HealthCheck(check))
+	}
+	// Health checks given on the command line replace the ones from the project file
+	if checks := loadHealthChecks(cmd); len(checks) > 0 {
+		config.HealthChecks = checks
+	}
+	return config, nil
+}
+
+// loadHealthChecks builds health checks from --health-http, --health-tcp and --health-cmd
+func loadHealthChecks(cmd *cli.Command) []HealthCheck {
+	var checks []HealthCheck
+	add := func(check HealthCheck) {
+		check.Retries = cmd.Int(flagx.FlagHealthRetries)
+		check.Timeout = cmd.Duration(flagx.FlagHealthTimeout)
+		checks = append(checks, check)
+	}
+	for _, u := range cmd.StringSlice(flagx.FlagHealthHTTP) {
+		add(HealthCheck{HTTP: u})
+	}
+	for _, addr := range cmd.StringSlice(flagx.FlagHealthTCP) {
+		add(HealthCheck{TCP: addr})
+	}
+	for _, c := range cmd.StringSlice(flagx.FlagHealthCmd) {
+		add(HealthCheck{Command: c})
 	}
+	return checks
 }
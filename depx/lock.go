@@ -0,0 +1,248 @@
+package depx
+
+import (
+	"bytes"
+	"chihqiang/depctl/sshx"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// LockCommand is the command of locks taken with depctl lock, they never become stale
+const LockCommand = "lock"
+
+// Lock is the content of the deploy lock file, identifying who holds it
+type Lock struct {
+	Owner    string    `json:"owner"`    // Local user holding the lock
+	Hostname string    `json:"hostname"` // Local machine holding the lock
+	PID      int       `json:"pid"`      // Process holding the lock
+	Command  string    `json:"command"`  // depctl command holding the lock, for example publish
+	Time     time.Time `json:"time"`     // When the lock was taken
+}
+
+// NewLock describes a lock held by this process for command
+func NewLock(command string) *Lock {
+	l := &Lock{
+		Owner:   os.Getenv("USER"),
+		PID:     os.Getpid(),
+		Command: command,
+		Time:    time.Now(),
+	}
+	if u, err := user.Current(); err == nil {
+		l.Owner = u.Username
+	}
+	l.Hostname, _ = os.Hostname()
+	return l
+}
+
+// String describes the holder for error messages
+func (l *Lock) String() string {
+	return fmt.Sprintf("%s@%s (pid %d, %s) since %s", l.Owner, l.Hostname, l.PID, l.Command, l.Time.Local().Format("2006-01-02 15:04:05"))
+}
+
+// sameOwner reports whether both locks were taken by the same user on the same machine
+func (l *Lock) sameOwner(o *Lock) bool {
+	return l.Owner == o.Owner && l.Hostname == o.Hostname
+}
+
+// sameHolder reports whether both locks were taken by the same process
+func (l *Lock) sameHolder(o *Lock) bool {
+	return l.sameOwner(o) && l.PID == o.PID && l.Time.Equal(o.Time)
+}
+
+// stale reports whether the lock was left behind by a run that did not release it
+func (l *Lock) stale(timeout time.Duration) bool {
+	return l.Command != LockCommand && timeout > 0 && time.Since(l.Time) > timeout
+}
+
+// ReadLock reads the deploy lock of the host, nil when the host is not locked
+func ReadLock(sftpClient *sftp.Client, config *Config) (*Lock, error) {
+	l, _, err := readLock(sftpClient, config.GetLockFile())
+	return l, err
+}
+
+// readLock reads a lock file and also returns its raw content
+func readLock(sftpClient *sftp.Client, filename string) (*Lock, []byte, error) {
+	f, err := sftpClient.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("open lock: %w", err)
+	}
+	defer f.Close()
+	raw, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read lock: %w", err)
+	}
+	l := &Lock{}
+	if err := json.Unmarshal(raw, l); err != nil {
+		// A lock file that cannot be read still locks, it is reported with what is known
+		// It may be one that another run is writing, so it only becomes stale by the age of the file
+		l = &Lock{Owner: "unknown", Command: "unknown"}
+		if info, err := f.Stat(); err == nil {
+			l.Time = info.ModTime()
+		}
+	}
+	return l, raw, nil
+}
+
+// AcquireLock takes the deploy lock of the host
+// The lock file is created exclusively, so only one of several concurrent runs succeeds
+// A stale lock older than config.LockTimeout is taken over, by one of several concurrent runs only
+func AcquireLock(host *Host, config *Config, lock *Lock) error {
+	sftpClient, err := sshx.OpenSftp(host.Client)
+	if err != nil {
+		return fmt.Errorf("create sftp client: %w", err)
+	}
+	defer sftpClient.Close()
+	if err := sshx.Mkdir(sftpClient, path.Dir(config.GetLockFile())); err != nil {
+		return fmt.Errorf("create %s: %w", path.Dir(config.GetLockFile()), err)
+	}
+	err = createLock(sftpClient, config, lock)
+	if err == nil || !os.IsExist(err) {
+		return err
+	}
+	held, raw, err := readLock(sftpClient, config.GetLockFile())
+	if err != nil {
+		return err
+	}
+	if held == nil || held.stale(config.LockTimeout) {
+		won := true
+		if held != nil {
+			if won, err = takeOverLock(sftpClient, config, raw); err != nil {
+				return err
+			}
+			if won {
+				host.Log.Warn("took over stale lock held by %s", held)
+			}
+		}
+		if won {
+			if err := createLock(sftpClient, config, lock); err == nil || !os.IsExist(err) {
+				return err
+			}
+		}
+		if held, err = ReadLock(sftpClient, config); err != nil || held == nil {
+			return fmt.Errorf("locked by another run")
+		}
+	}
+	return fmt.Errorf("locked by %s, use depctl unlock --force if it is stale", held)
+}
+
+// takeOverLock removes the stale lock file with content stale, won is false when another run took it over first
+// Runs taking over a lock hold an exclusively created guard file meanwhile, and the lock file is only
+// removed while it still holds what was read, so a lock taken in the meantime is never removed
+func takeOverLock(sftpClient *sftp.Client, config *Config, stale []byte) (won bool, err error) {
+	guard := config.GetTakeoverFile()
+	f, err := createExclusive(sftpClient, guard)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("create %s: %w", guard, err)
+	}
+	_ = f.Close()
+	defer func() { _ = sftpClient.Remove(guard) }()
+	_, current, err := readLock(sftpClient, config.GetLockFile())
+	if err != nil || !bytes.Equal(current, stale) {
+		return false, err
+	}
+	if err := sftpClient.Remove(config.GetLockFile()); err != nil {
+		return false, fmt.Errorf("remove stale lock: %w", err)
+	}
+	return true, nil
+}
+
+// createLock creates the lock file, failing with an os.IsExist error when it already exists
+func createLock(sftpClient *sftp.Client, config *Config, lock *Lock) error {
+	f, err := createExclusive(sftpClient, config.GetLockFile())
+	if err != nil {
+		if os.IsExist(err) {
+			return err
+		}
+		return fmt.Errorf("create lock: %w", err)
+	}
+	defer f.Close()
+	b, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("write lock: %w", err)
+	}
+	return nil
+}
+
+// createExclusive creates a new file, failing with os.ErrExist when it already exists
+// SFTP servers report an existing file as a generic failure, which is also what is left when the file
+// was removed again by the time it is checked, so a generic failure counts as the file existing
+func createExclusive(sftpClient *sftp.Client, filename string) (*sftp.File, error) {
+	f, err := sftpClient.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err == nil {
+		return f, nil
+	}
+	var status *sftp.StatusError
+	if errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxFailure {
+		return nil, os.ErrExist
+	}
+	if _, statErr := sftpClient.Lstat(filename); statErr == nil {
+		return nil, os.ErrExist
+	}
+	return nil, err
+}
+
+// ReleaseLock removes the deploy lock of the host if it is still held by lock
+func ReleaseLock(host *Host, config *Config, lock *Lock) error {
+	sftpClient, err := sshx.OpenSftp(host.Client)
+	if err != nil {
+		return fmt.Errorf("create sftp client: %w", err)
+	}
+	defer sftpClient.Close()
+	held, err := ReadLock(sftpClient, config)
+	if err != nil {
+		return err
+	}
+	// The lock may have been taken over as stale or removed with unlock --force
+	if held == nil || !held.sameHolder(lock) {
+		return nil
+	}
+	if err := sftpClient.Remove(config.GetLockFile()); err != nil {
+		return fmt.Errorf("remove lock: %w", err)
+	}
+	return nil
+}
+
+// Unlock removes the deploy lock of the host
+// Without force only locks taken by the same user on this machine are removed
+func Unlock(host *Host, config *Config, force bool) error {
+	sftpClient, err := sshx.OpenSftp(host.Client)
+	if err != nil {
+		return fmt.Errorf("create sftp client: %w", err)
+	}
+	defer sftpClient.Close()
+	held, err := ReadLock(sftpClient, config)
+	if err != nil {
+		return err
+	}
+	if held == nil {
+		host.Log.Info("Not locked")
+		return nil
+	}
+	if !force && !held.sameOwner(NewLock(LockCommand)) {
+		return fmt.Errorf("locked by %s, use --force to remove it", held)
+	}
+	if err := sftpClient.Remove(config.GetLockFile()); err != nil {
+		return fmt.Errorf("remove lock: %w", err)
+	}
+	// A run interrupted while taking over a stale lock leaves its guard behind
+	_ = sftpClient.Remove(config.GetTakeoverFile())
+	host.Log.Info("Removed lock held by %s", held)
+	return nil
+}
@@ -0,0 +1,135 @@
+package depx
+
+import (
+	"chihqiang/depctl/sshx"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// ManifestFile is the path of the release manifest inside every release
+const ManifestFile = ".depctl/release.json"
+
+// Manifest describes where a release came from, written into the release as ManifestFile
+type Manifest struct {
+	Version  string    `json:"version"`  // Release version
+	User     string    `json:"user"`     // Local user who deployed the release
+	Hostname string    `json:"hostname"` // Local machine the release was deployed from
+	Time     time.Time `json:"time"`     // When the release was packed
+	Git      *GitInfo  `json:"git,omitempty"`
+	Checksum string    `json:"checksum"` // SHA-256 of the uploaded archive
+	Files    int       `json:"files"`    // Number of regular files
+	Size     int64     `json:"size"`     // Total size of the regular files in bytes
+}
+
+// GitInfo is the state of the git work tree the release was packed from
+type GitInfo struct {
+	Commit string `json:"commit"`
+	Branch string `json:"branch"`
+	Dirty  bool   `json:"dirty"` // Whether the work tree had uncommitted changes
+}
+
+// NewManifest describes a release packed from config.Dir, or opened from config.Artifact
+// A pre-built artifact records no git state, the local work tree says nothing about how it was built
+func NewManifest(config *Config, artifact *Artifact) *Manifest {
+	m := &Manifest{
+		Version:  config.Version,
+		Time:     time.Now(),
+		Checksum: artifact.Checksum,
+		Files:    artifact.Files,
+		Size:     artifact.Size,
+	}
+	if config.Artifact == "" {
+		m.Git = readGitInfo(config.Dir, config.GitRef)
+	}
+	if u, err := user.Current(); err == nil {
+		m.User = u.Username
+	} else {
+		m.User = os.Getenv("USER")
+	}
+	m.Hostname, _ = os.Hostname()
+	return m
+}
+
+// readGitInfo returns the git state of dir, or nil when dir is not in a git work tree
+// With ref the release comes from that commit, and is never dirty
+func readGitInfo(dir, ref string) *GitInfo {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	commit, err := git(dir, "rev-parse", ref+"^{commit}")
+	if err != nil {
+		return nil
+	}
+	info := &GitInfo{Commit: commit}
+	if name, err := git(dir, "rev-parse", "--symbolic-full-name", ref); err == nil {
+		info.Branch = strings.TrimPrefix(name, "refs/heads/")
+		if info.Branch == name {
+			info.Branch = ""
+		}
+	}
+	if ref == "HEAD" {
+		// Only changes below dir make the release dirty, as for the clean check
+		if status, err := gitStatus(dir); err == nil && status != "" {
+			info.Dirty = true
+		}
+	}
+	return info
+}
+
+// writeManifest writes the manifest into releaseDir
+func writeManifest(sftpClient *sftp.Client, releaseDir string, m *Manifest) error {
+	return writeJSON(sftpClient, path.Join(releaseDir, ManifestFile), m)
+}
+
+// writeJSON writes v as indented JSON to the remote file filename, creating its directory
+func writeJSON(sftpClient *sftp.Client, filename string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := sshx.Mkdir(sftpClient, path.Dir(filename)); err != nil {
+		return fmt.Errorf("create %s: %w", path.Dir(filename), err)
+	}
+	f, err := sftpClient.Create(filename)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", filename, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("write %s: %w", filename, err)
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest of releaseDir
+// Releases deployed before manifests existed return nil and no error
+func ReadManifest(sftpClient *sftp.Client, releaseDir string) (*Manifest, error) {
+	m := &Manifest{}
+	if ok, err := readJSON(sftpClient, path.Join(releaseDir, ManifestFile), m); !ok {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readJSON decodes the remote JSON file filename into v, ok is false when it does not exist or fails to parse
+func readJSON(sftpClient *sftp.Client, filename string, v interface{}) (ok bool, err error) {
+	f, err := sftpClient.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return false, fmt.Errorf("parse %s: %w", filename, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,47 @@
+package depx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ownerOverride replaces the owner or group of every archived file
+// It is parsed from name, id or name:id; an empty value keeps the local owner
+type ownerOverride struct {
+	set  bool
+	name string
+	id   int
+}
+
+// parseOwner parses an --owner or --group value
+// A bare name clears the numeric id so the remote tar resolves the name, a bare id clears the name
+func parseOwner(value string) (ownerOverride, error) {
+	if value == "" {
+		return ownerOverride{}, nil
+	}
+	o := ownerOverride{set: true}
+	name, id, hasID := strings.Cut(value, ":")
+	if !hasID {
+		if n, err := strconv.Atoi(value); err == nil {
+			name, id, hasID = "", strconv.Itoa(n), true
+		}
+	}
+	o.name = name
+	if hasID {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 0 {
+			return o, fmt.Errorf("invalid owner %q, use name, id or name:id", value)
+		}
+		o.id = n
+	}
+	return o, nil
+}
+
+// apply overrides the name and id of a tar header field pair
+func (o ownerOverride) apply(name *string, id *int) {
+	if !o.set {
+		return
+	}
+	*name, *id = o.name, o.id
+}
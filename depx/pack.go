@@ -3,116 +3,355 @@ package depx
 import (
 	"archive/tar"
 	"chihqiang/depctl/utilx"
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
+	"time"
 )
 
-// PackDir compresses directory dir to tar.gz with a beautiful progress bar
-func PackDir(config *Config) (string, error) {
+// Artifact is a release ready for upload
+// It is either packed once into a local tar.gz file, or written straight into the
+// upload stream of a single host without a temporary file
+type Artifact struct {
+	Path     string    // Local path of the tar.gz file, empty when the archive is streamed
+	Checksum string    // SHA-256 of the tar.gz archive, hex encoded, known once it was written
+	Files    int       // Number of regular files in the release, known once it was written
+	Size     int64     // Total size of the regular files before compression
+	Manifest *Manifest // Manifest written into the release on every host
+
+	Compression Compression // Format the tar archive is compressed with
+
+	config    *Config  // Configuration the archive is packed from
+	entries   []string // Files and directories in the archive, relative to config.Dir
+	zip       string   // Pre-built zip archive repacked as tar.gz, instead of config.Dir
+	temporary bool     // Path is a temporary file removed by Cleanup
+	tempDir   string   // Tree exported from --git-ref, removed by Cleanup
+
+	sums   map[string]FileSum // Regular files with their checksums, only with --delta
+	skip   map[string]bool    // Files hard-linked on the host instead of packed
+	linked int                // Number of files in skip
+}
+
+// NewArtifact collects the files to pack from config.Dir without writing an archive yet,
+// from the tree of config.GitRef, or opens the pre-built archive of config.Artifact
+// A working tree with uncommitted changes is refused unless config.AllowDirty
+// Use PackDir for an archive shared by several hosts, or pass it to PrepareHost to stream it to a single host
+func NewArtifact(config *Config) (*Artifact, error) {
 	if err := config.Validate(); err != nil {
-		return "", err
+		return nil, err
+	}
+	if config.Artifact != "" {
+		return openArtifact(config)
+	}
+	// The exported tree is packed with the same include, exclude and ignore rules as the working tree
+	packConfig, tempDir := config, ""
+	if config.GitRef != "" {
+		dir, err := exportGitRef(config)
+		if err != nil {
+			return nil, err
+		}
+		exported := *config
+		exported.Dir = dir
+		packConfig, tempDir = &exported, dir
+	} else if !config.AllowDirty {
+		if err := checkClean(config.Dir); err != nil {
+			return nil, err
+		}
+	}
+	entries, totalSize, err := PackFiles(packConfig)
+	if err != nil {
+		_ = os.RemoveAll(tempDir)
+		return nil, err
+	}
+	artifact := &Artifact{
+		Size:        totalSize,
+		Compression: config.Compression,
+		config:      packConfig,
+		entries:     entries,
+		tempDir:     tempDir,
+	}
+	// With --delta every file is hashed up front, to compare it with the release on each host
+	if config.Delta {
+		if artifact.sums, err = hashFiles(packConfig, entries); err != nil {
+			artifact.Cleanup()
+			return nil, err
+		}
 	}
-	tarName := fmt.Sprintf("%s.tar.gz", config.Version)
-	tarPath := filepath.Join(os.TempDir(), tarName)
-	file, err := os.Create(tarPath)
+	artifact.Manifest = NewManifest(config, artifact)
+	return artifact, nil
+}
+
+// Entries returns the files and directories in the archive
+func (a *Artifact) Entries() []string {
+	return a.entries
+}
+
+// Cleanup removes the temporary archive file and exported tree, a pre-built artifact is kept
+func (a *Artifact) Cleanup() {
+	if a.temporary {
+		_ = os.Remove(a.Path)
+	}
+	if a.tempDir != "" {
+		_ = os.RemoveAll(a.tempDir)
+	}
+}
+
+// Streamed reports whether the archive is written straight into the upload instead of a local file
+func (a *Artifact) Streamed() bool {
+	return a.Path == ""
+}
+
+// PackDir compresses directory dir to tar.gz with a beautiful progress bar
+// The archive is written to a uniquely named temporary file, so concurrent runs do not clobber each other
+func PackDir(config *Config) (*Artifact, error) {
+	artifact, err := NewArtifact(config)
+	if err != nil {
+		return nil, err
+	}
+	// A pre-built tar archive is uploaded as it is
+	if !artifact.Streamed() {
+		return artifact, nil
+	}
+	file, err := os.CreateTemp("", fmt.Sprintf("depctl-%s-*%s", config.Version, artifact.Compression.Ext()))
 	if err != nil {
-		return "", fmt.Errorf("create tar.gz file failed: %w", err)
+		artifact.Cleanup()
+		return nil, fmt.Errorf("create archive file failed: %w", err)
 	}
 	defer file.Close()
-	gw := gzip.NewWriter(file)
-	defer gw.Close()
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
-	// 1. Collect files to be packed and calculate total size
-	var totalSize int64
-	var files []string
-	err = filepath.Walk(config.Dir, func(path string, info os.FileInfo, err error) error {
+	if err := artifact.Pack(file, utilx.NewProgress(artifact.Size, "Packing")); err != nil {
+		_ = os.Remove(file.Name())
+		artifact.Cleanup()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		artifact.Cleanup()
+		return nil, err
+	}
+	artifact.Path = file.Name()
+	artifact.temporary = true
+	return artifact, nil
+}
+
+// Pack writes the archive compressed in a.Compression to w, reporting the bytes packed to bar
+// Checksum, Files and the manifest are filled in once the archive is complete
+func (a *Artifact) Pack(w io.Writer, bar utilx.Progress) error {
+	config := a.config
+	hash := sha256.New()
+	cw, err := newCompressor(io.MultiWriter(w, hash), a.Compression, config.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+
+	// 1. Reproducible archives and owner overrides rewrite every header
+	owner, err := parseOwner(config.Owner)
+	if err != nil {
+		return err
+	}
+	group, err := parseOwner(config.Group)
+	if err != nil {
+		return err
+	}
+	var epoch time.Time
+	if config.Reproducible {
+		if epoch, err = sourceDateEpoch(); err != nil {
+			return err
+		}
+	}
+	prepare := func(header *tar.Header) {
+		if config.Reproducible {
+			normalizeHeader(header, epoch)
+		}
+		owner.apply(&header.Uname, &header.Uid)
+		group.apply(&header.Gname, &header.Gid)
+	}
+
+	// 2. Write files and update progress bar
+	if a.zip != "" {
+		err = a.packZip(tw, prepare, bar)
+	} else {
+		err = a.packDir(tw, prepare, bar)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 3. Flush the archive before it is hashed
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	a.Checksum = hex.EncodeToString(hash.Sum(nil))
+	if a.Manifest != nil {
+		a.Manifest.Checksum, a.Manifest.Files = a.Checksum, a.Files+a.linked
+	}
+	return nil
+}
+
+// packDir writes the files of config.Dir to the archive, except the files hard-linked on the host
+// Symlinks are archived as links, not followed; hard links to a file already written are archived as links to it
+func (a *Artifact) packDir(tw *tar.Writer, prepare func(header *tar.Header), bar utilx.Progress) error {
+	var written int64
+	a.Files = 0
+	linked := make(map[fileID]string)
+	for _, relPath := range a.entries {
+		if a.skip[filepath.ToSlash(relPath)] {
+			continue
+		}
+		filename := filepath.Join(a.config.Dir, relPath)
+		info, err := os.Lstat(filename)
 		if err != nil {
 			return err
 		}
-		relPath, _ := filepath.Rel(config.Dir, path)
-		if relPath == "." {
-			return nil
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(filename); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
 		}
-		// Include / Exclude
-		if len(config.Include) > 0 {
-			found := false
-			for _, p := range config.Include {
-				if strings.HasPrefix(relPath, p) {
-					found = true
-					break
+		header.Name = filepath.ToSlash(relPath)
+		prepare(header)
+
+		if info.Mode().IsRegular() {
+			a.Files++
+			if id, ok := hardLinkID(info); ok {
+				if first, seen := linked[id]; seen {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = first
+					header.Size = 0
+					written += info.Size()
+					_ = bar.Set64(written)
+				} else {
+					linked[id] = header.Name
 				}
 			}
-			if !found {
-				return nil
-			}
 		}
-		if len(config.Exclude) > 0 {
-			for _, p := range config.Exclude {
-				if strings.HasPrefix(relPath, p) {
-					return nil
-				}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			if err := copyFile(tw, filename, func(n int64) {
+				written += n
+				_ = bar.Set64(written)
+			}); err != nil {
+				return err
 			}
 		}
+	}
+	return nil
+}
 
-		if info.Mode().IsRegular() {
-			totalSize += info.Size()
-		}
-		files = append(files, path)
-		return nil
-	})
+// normalizeHeader removes everything from a header that differs between checkouts of the same tree
+// Entries are already in a stable order since the directory is walked in lexical order
+func normalizeHeader(header *tar.Header, epoch time.Time) {
+	header.ModTime = epoch
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.Uid, header.Gid = 0, 0
+	header.Uname, header.Gname = "", ""
+	header.PAXRecords = nil
+}
+
+// sourceDateEpoch returns the timestamp of reproducible archives:
+// SOURCE_DATE_EPOCH when set, otherwise the Unix epoch
+func sourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Unix(0, 0), nil
+	}
+	sec, err := strconv.ParseInt(value, 10, 64)
 	if err != nil {
-		return "", fmt.Errorf("walk directory failed: %w", err)
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", value, err)
 	}
+	return time.Unix(sec, 0), nil
+}
 
-	// 2. Create progress bar
-	bar := utilx.NewProgress(totalSize, "Packing")
-	// 3. Write files and update progress bar
-	var written int64
-	for _, filename := range files {
-		info, err := os.Stat(filename)
+// copyFile writes the content of filename to the archive, reporting the bytes written
+func copyFile(w io.Writer, filename string, progress func(n int64)) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, errw := w.Write(buf[:n]); errw != nil {
+				return errw
+			}
+			progress(int64(n))
+		}
 		if err != nil {
-			return "", err
+			if err == io.EOF {
+				return nil
+			}
+			return err
 		}
-		relPath, _ := filepath.Rel(config.Dir, filename)
+	}
+}
 
-		header, err := tar.FileInfoHeader(info, info.Name())
+// PackFiles lists the files and directories PackDir packs, relative to config.Dir,
+// and the total size of the regular files among them
+// Include and exclude are gitignore-style patterns, see Patterns; .depctlignore files in
+// --dir and its subdirectories, and .gitignore files with --respect-gitignore, exclude as well
+func PackFiles(config *Config) ([]string, int64, error) {
+	include, err := ParsePatterns(config.Include)
+	if err != nil {
+		return nil, 0, fmt.Errorf("include: %w", err)
+	}
+	ignore, err := newIgnoreTree(config)
+	if err != nil {
+		return nil, 0, err
+	}
+	var totalSize int64
+	var files []string
+	err = filepath.Walk(config.Dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return "", err
+			return err
 		}
-		header.Name = relPath
-		if err := tw.WriteHeader(header); err != nil {
-			return "", err
+		relPath, _ := filepath.Rel(config.Dir, path)
+		if relPath == "." {
+			return ignore.load("")
 		}
-
-		if info.Mode().IsRegular() {
-			f, err := os.Open(filename)
-			if err != nil {
-				return "", err
+		rel := filepath.ToSlash(relPath)
+		// Exclude and ignore files, an excluded directory is skipped with everything in it
+		if ignore.Ignored(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
-			defer f.Close()
-			buf := make([]byte, 32*1024)
-			for {
-				n, err := f.Read(buf)
-				if n > 0 {
-					if _, errw := tw.Write(buf[:n]); errw != nil {
-						return "", errw
-					}
-					written += int64(n)
-					_ = bar.Set64(written)
-				}
-				if err != nil {
-					if err == io.EOF {
-						break
-					}
-					return "", err
-				}
+			return nil
+		}
+		if info.IsDir() {
+			if err := ignore.load(rel); err != nil {
+				return err
 			}
 		}
+		// Include, directories are still walked since files inside them may be included
+		if len(include) > 0 && !include.Match(rel, info.IsDir()) {
+			return nil
+		}
+
+		if info.Mode().IsRegular() {
+			totalSize += info.Size()
+		}
+		files = append(files, relPath)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("walk directory failed: %w", err)
 	}
-	return tarPath, nil
+	return files, totalSize, nil
 }
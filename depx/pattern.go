@@ -0,0 +1,133 @@
+package depx
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pattern is one gitignore-style pattern
+type pattern struct {
+	source   string   // Pattern as written, for error messages
+	negate   bool     // Leading !, re-includes what earlier patterns matched
+	dirOnly  bool     // Trailing /, only matches directories
+	segments []string // Path segments, ** matches any number of directories
+}
+
+// Patterns is an ordered list of gitignore-style patterns, later patterns take precedence
+//
+//   - *, ? and [...] match within one path segment, ** matches any number of directories
+//   - a leading ! negates the pattern
+//   - a leading / anchors the pattern to the base directory, as does a / in the middle;
+//     without one the pattern matches at any depth
+//   - a trailing / matches directories only
+//   - a matching directory also matches everything below it
+type Patterns []pattern
+
+// ParsePatterns parses gitignore-style patterns, empty lines and # comments are skipped
+func ParsePatterns(lines []string) (Patterns, error) {
+	var ps Patterns
+	for _, line := range lines {
+		p, ok, err := parsePattern(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ps = append(ps, p)
+		}
+	}
+	return ps, nil
+}
+
+// parsePattern parses one pattern, ok is false for empty lines and comments
+func parsePattern(line string) (p pattern, ok bool, err error) {
+	p.source = line
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return p, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return p, false, fmt.Errorf("invalid pattern %q", p.source)
+	}
+	p.segments = strings.Split(line, "/")
+	if !anchored {
+		p.segments = append([]string{"**"}, p.segments...)
+	}
+	for _, seg := range p.segments {
+		if _, err := path.Match(seg, ""); err != nil {
+			return p, false, fmt.Errorf("invalid pattern %q: %w", p.source, err)
+		}
+	}
+	return p, true, nil
+}
+
+// match reports whether the pattern matches the slash separated path itself
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(p.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches pattern segments against path segments
+func matchSegments(pat, parts []string) bool {
+	if len(pat) == 0 {
+		return len(parts) == 0
+	}
+	if pat[0] == "**" {
+		// A trailing ** matches everything inside, but not the directory itself
+		if len(pat) == 1 {
+			return len(parts) > 0
+		}
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(pat[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pat[0], parts[0]); !ok {
+		return false
+	}
+	return matchSegments(pat[1:], parts[1:])
+}
+
+// Match reports whether rel, a slash separated path relative to the base directory, is matched
+// The last pattern matching the path decides; when none does, the nearest matched parent directory decides
+func (ps Patterns) Match(rel string, isDir bool) bool {
+	for {
+		if matched, ok := ps.matchLast(rel, isDir); ok {
+			return matched
+		}
+		parent := path.Dir(rel)
+		if parent == "." || parent == "/" || parent == rel {
+			return false
+		}
+		rel, isDir = parent, true
+	}
+}
+
+// matchLast returns the outcome of the last pattern matching rel itself, ok is false when none matches
+func (ps Patterns) matchLast(rel string, isDir bool) (matched, ok bool) {
+	for i := len(ps) - 1; i >= 0; i-- {
+		if ps[i].match(rel, isDir) {
+			return !ps[i].negate, true
+		}
+	}
+	return false, false
+}
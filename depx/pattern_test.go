@@ -0,0 +1,118 @@
+package depx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		line     string
+		ok       bool
+		wantErr  bool
+		negate   bool
+		dirOnly  bool
+		segments []string
+	}{
+		{line: "", ok: false},
+		{line: "   ", ok: false},
+		{line: "# comment", ok: false},
+		{line: "*.log", ok: true, segments: []string{"**", "*.log"}},
+		{line: "*.log  ", ok: true, segments: []string{"**", "*.log"}},
+		{line: "/vendor", ok: true, segments: []string{"vendor"}},
+		{line: "docs/build", ok: true, segments: []string{"docs", "build"}},
+		{line: "node_modules/", ok: true, dirOnly: true, segments: []string{"**", "node_modules"}},
+		{line: "/tmp/", ok: true, dirOnly: true, segments: []string{"tmp"}},
+		{line: "!keep.log", ok: true, negate: true, segments: []string{"**", "keep.log"}},
+		{line: `\!important`, ok: true, segments: []string{"**", "!important"}},
+		{line: `\#hash`, ok: true, segments: []string{"**", "#hash"}},
+		{line: "src/**/test", ok: true, segments: []string{"src", "**", "test"}},
+		{line: "/", wantErr: true},
+		{line: "!", wantErr: true},
+		{line: "[", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			p, ok, err := parsePattern(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePattern(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ok != tt.ok {
+				t.Fatalf("parsePattern(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if p.negate != tt.negate || p.dirOnly != tt.dirOnly || !reflect.DeepEqual(p.segments, tt.segments) {
+				t.Errorf("parsePattern(%q) = negate %v, dirOnly %v, segments %q; want negate %v, dirOnly %v, segments %q",
+					tt.line, p.negate, p.dirOnly, p.segments, tt.negate, tt.dirOnly, tt.segments)
+			}
+		})
+	}
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pat   []string
+		parts []string
+		want  bool
+	}{
+		{[]string{"a"}, []string{"a"}, true},
+		{[]string{"a"}, []string{"b"}, false},
+		{[]string{"a"}, []string{"a", "b"}, false},
+		{[]string{"*.go"}, []string{"main.go"}, true},
+		{[]string{"?.go"}, []string{"ab.go"}, false},
+		{[]string{"[ab].txt"}, []string{"b.txt"}, true},
+		{[]string{"**", "a"}, []string{"a"}, true},
+		{[]string{"**", "a"}, []string{"x", "y", "a"}, true},
+		{[]string{"**", "a"}, []string{"x", "a", "y"}, false},
+		{[]string{"a", "**", "b"}, []string{"a", "b"}, true},
+		{[]string{"a", "**", "b"}, []string{"a", "x", "y", "b"}, true},
+		{[]string{"a", "**"}, []string{"a", "x"}, true},
+		{[]string{"a", "**"}, []string{"a"}, false},
+		{[]string{"*"}, []string{"a", "b"}, false},
+	}
+	for _, tt := range tests {
+		if got := matchSegments(tt.pat, tt.parts); got != tt.want {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", tt.pat, tt.parts, got, tt.want)
+		}
+	}
+}
+
+func TestPatternsMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"no patterns", nil, "a.txt", false, false},
+		{"at any depth", []string{"*.log"}, "logs/app/error.log", false, true},
+		{"anchored at the root", []string{"/build"}, "build", true, true},
+		{"anchored not below", []string{"/build"}, "src/build", true, false},
+		{"directory only skips files", []string{"cache/"}, "cache", false, false},
+		{"directory only matches directories", []string{"cache/"}, "cache", true, true},
+		{"inside a matched directory", []string{"node_modules/"}, "web/node_modules/x/index.js", false, true},
+		{"negation re-includes", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"last pattern wins", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"negated file inside an excluded directory", []string{"vendor/", "!vendor/keep.go"}, "vendor/keep.go", false, false},
+		{"other files inside an excluded directory", []string{"vendor/", "!vendor/keep.go"}, "vendor/drop.go", false, true},
+		{"double star in the middle", []string{"src/**/testdata"}, "src/a/b/testdata/x.json", false, true},
+		{"unrelated path", []string{"src/**/testdata"}, "lib/testdata/x.json", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := ParsePatterns(tt.lines)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ps.Match(tt.rel, tt.isDir); got != tt.want {
+				t.Errorf("Match(%q, %v) with %q = %v, want %v", tt.rel, tt.isDir, tt.lines, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package depx
+
+import (
+	"chihqiang/depctl/sshx"
+	"chihqiang/depctl/utilx"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// Plan lists the steps a command would take on one host, without changing anything
+type Plan struct {
+	Host  string
+	Steps []string
+}
+
+// add appends a step to the plan
+func (p *Plan) add(format string, args ...interface{}) {
+	p.Steps = append(p.Steps, fmt.Sprintf(format, args...))
+}
+
+// String formats the plan for printing
+func (p *Plan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plan for %s:\n", p.Host)
+	for _, step := range p.Steps {
+		fmt.Fprintf(&b, "  - %s\n", step)
+	}
+	return b.String()
+}
+
+// PlanPublish runs the pre-deployment checks and describes what PostDeployHost would do with artifact
+// Only reads from the host, nothing is created, uploaded or switched
+func PlanPublish(host *Host, artifact *Artifact, config *Config) (*Plan, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	sftpClient, err := sshx.OpenSftp(host.Client)
+	if err != nil {
+		return nil, fmt.Errorf("create sftp client: %w", err)
+	}
+	defer sftpClient.Close()
+	// 1. The same checks a deployment starts with
+	if err := preDeployChecks(sftpClient, config); err != nil {
+		return nil, err
+	}
+	if err := checkRemoteTar(host, artifact.Compression); err != nil {
+		return nil, err
+	}
+	plan := &Plan{Host: host.Name}
+	planLock(sftpClient, config, plan)
+	versionDir := config.GetVersionRemoteDir()
+
+	// 2. Directories and upload
+	dirs := []string{path.Dir(config.GetCurrentLink()), versionDir}
+	if len(config.SharedDirs) > 0 || len(config.SharedFiles) > 0 {
+		dirs = append(dirs, config.GetSharedDir())
+	}
+	dirs = append(dirs, path.Dir(config.GetRecordsFile()))
+	for _, dir := range dirs {
+		if !sshx.RemoteExists(sftpClient, dir) {
+			plan.add("create directory %s", dir)
+		}
+	}
+	entries, size := len(artifact.Entries()), artifact.Size
+	if config.Delta {
+		var unchanged map[string]FileSum
+		current, _ := sshx.ReadLink(sftpClient, config.GetCurrentLink())
+		if current != "" {
+			unchanged, err = unchangedFiles(sftpClient, current, artifact.sums)
+		}
+		if err != nil {
+			plan.add("WARNING: delta upload unavailable, uploading every file: %v", err)
+		} else if len(unchanged) > 0 {
+			var linked int64
+			for _, sum := range unchanged {
+				linked += sum.Size
+			}
+			entries, size = entries-len(unchanged), size-linked
+			plan.add("hard-link %d unchanged files (%s) from %s", len(unchanged), utilx.FormatBytes(linked), current)
+		}
+	}
+	plan.add("upload %d entries (%s) as %s and extract them into %s",
+		entries, utilx.FormatBytes(size), artifact.Compression, versionDir)
+	plan.add("write manifest %s", path.Join(versionDir, ManifestFile))
+	if config.Delta {
+		plan.add("write file checksums %s", path.Join(versionDir, FilesFile))
+	}
+
+	// 3. Shared paths
+	for _, p := range append(append([]string{}, config.SharedDirs...), config.SharedFiles...) {
+		shared := path.Join(config.GetSharedDir(), path.Clean(p))
+		if !sshx.RemoteExists(sftpClient, shared) {
+			plan.add("create %s, seeded from the release when it contains it", shared)
+		}
+		plan.add("link %s -> %s", path.Join(versionDir, path.Clean(p)), shared)
+	}
+
+	// 4. Hooks, switch and checks
+	planSwitch(sftpClient, config, plan, versionDir)
+	for _, check := range config.HealthChecks {
+		plan.add("health check %s, rolling back on failure", check)
+	}
+	if config.Keep > 0 {
+		plan.add("remove releases beyond the newest %d, keeping the current and previous release", config.Keep)
+	}
+	return plan, nil
+}
+
+// PlanRollback describes what RollbackHost would do for the release of config.Version
+func PlanRollback(host *Host, config *Config) (*Plan, error) {
+	sftpClient, err := sshx.OpenSftp(host.Client)
+	if err != nil {
+		return nil, fmt.Errorf("create sftp client: %w", err)
+	}
+	defer sftpClient.Close()
+	plan := &Plan{Host: host.Name}
+	planLock(sftpClient, config, plan)
+	planSwitch(sftpClient, config, plan, config.GetVersionRemoteDir())
+	return plan, nil
+}
+
+// planLock notes when another run holds the deploy lock
+func planLock(sftpClient *sftp.Client, config *Config, plan *Plan) {
+	if held, err := ReadLock(sftpClient, config); err == nil && held != nil {
+		plan.add("WARNING: locked by %s", held)
+	}
+}
+
+// planSwitch describes the hooks and the symlink change for releaseDir
+func planSwitch(sftpClient *sftp.Client, config *Config, plan *Plan, releaseDir string) {
+	if hookPre := config.GetHookPre(); hookPre != "" {
+		plan.add("run pre-hook in %s: %s", releaseDir, hookPre)
+	}
+	current, err := sshx.ReadLink(sftpClient, config.GetCurrentLink())
+	if err != nil || current == "" {
+		current = "(none)"
+	}
+	plan.add("switch %s from %s to %s", config.GetCurrentLink(), current, releaseDir)
+	if hookPost := config.GetHookPost(); hookPost != "" {
+		plan.add("run post-hook in %s: %s", releaseDir, hookPost)
+	}
+}
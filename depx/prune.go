@@ -0,0 +1,87 @@
+package depx
+
+import (
+	"chihqiang/depctl/sshx"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PruneOptions selects the releases removed by PruneReleases
+type PruneOptions struct {
+	Keep      int           // Number of newest releases to keep, 0 keeps none besides current and previous
+	OlderThan time.Duration // Only remove releases older than this, 0 removes regardless of age
+	DryRun    bool          // Only report what would be removed
+	Previous  string        // Release that was active before the current one, detected when empty
+}
+
+// PruneReleases removes old releases under remoteRepo
+// The release currentLink points to and the previous release are never removed
+// Returns the removed (or, in dry-run mode, the removable) release paths
+func PruneReleases(host *Host, config *Config, opts PruneOptions) ([]string, error) {
+	sftpClient, err := sshx.OpenSftp(host.Client)
+	if err != nil {
+		return nil, fmt.Errorf("create sftp client: %w", err)
+	}
+	defer sftpClient.Close()
+
+	// 1. List releases, newest first
+	list, err := sshx.List(sftpClient, config.GetRemoteRepo(), config.GetCurrentLink())
+	if err != nil {
+		return nil, fmt.Errorf("list releases: %w", err)
+	}
+	var releases []sshx.FileInfo
+	for _, fi := range list {
+		if fi.FileInfo.IsDir() {
+			releases = append(releases, fi)
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].FileInfo.ModTime().After(releases[j].FileInfo.ModTime())
+	})
+
+	// 2. Protect current and previous releases, previous comes from the deployment records when known
+	if opts.Previous == "" {
+		if current, err := sshx.ReadLink(sftpClient, config.GetCurrentLink()); err == nil {
+			if records, err := ReadRecords(sftpClient, config); err == nil {
+				opts.Previous, _ = PreviousRelease(records, current, 1)
+			}
+		}
+	}
+	protected := map[string]bool{}
+	if opts.Previous != "" {
+		protected[opts.Previous] = true
+	}
+	for i, fi := range releases {
+		if !fi.IsLink {
+			continue
+		}
+		protected[fi.Path] = true
+		// Without a known previous release, the next older one is treated as previous
+		if opts.Previous == "" && i+1 < len(releases) {
+			protected[releases[i+1].Path] = true
+		}
+	}
+
+	// 3. Remove everything beyond --keep that is older than --older-than
+	var removed []string
+	cutoff := time.Now().Add(-opts.OlderThan)
+	for i, fi := range releases {
+		if i < opts.Keep || protected[fi.Path] {
+			continue
+		}
+		if opts.OlderThan > 0 && fi.FileInfo.ModTime().After(cutoff) {
+			continue
+		}
+		if opts.DryRun {
+			host.Log.Info("Would remove release %s", fi.Path)
+		} else {
+			if _, err := sshx.Command(host.Client, fmt.Sprintf("rm -rf %q", fi.Path)); err != nil {
+				return removed, fmt.Errorf("remove release %s: %w", fi.Path, err)
+			}
+			host.Log.Info("Removed release %s", fi.Path)
+		}
+		removed = append(removed, fi.Path)
+	}
+	return removed, nil
+}
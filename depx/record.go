@@ -0,0 +1,162 @@
+package depx
+
+import (
+	"bufio"
+	"chihqiang/depctl/sshx"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Record actions
+const (
+	RecordPublish  = "publish"
+	RecordRollback = "rollback"
+)
+
+// Record is one switch of currentLink, appended to the deployment records of a host
+type Record struct {
+	Time    time.Time `json:"time"`    // When currentLink was switched
+	Action  string    `json:"action"`  // publish or rollback
+	Release string    `json:"release"` // Release directory currentLink points to
+	User    string    `json:"user"`    // Local user who ran depctl
+}
+
+// ReadRecords reads the deployment records of the host, oldest first
+// A host without records returns no records and no error
+func ReadRecords(sftpClient *sftp.Client, config *Config) ([]Record, error) {
+	f, err := sftpClient.Open(config.GetRecordsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("open deployment records: %w", err)
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		// Skip lines that were cut short by an interrupted write
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Release == "" {
+			continue
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read deployment records: %w", err)
+	}
+	return records, nil
+}
+
+// appendRecord records that currentLink was switched to release
+// The first record of a host also records the release that was active before, so deployments
+// made before records existed can still be rolled back
+func appendRecord(host *Host, config *Config, action, release string) error {
+	sftpClient, err := sshx.OpenSftp(host.Client)
+	if err != nil {
+		return fmt.Errorf("create sftp client: %w", err)
+	}
+	defer sftpClient.Close()
+	records, err := ReadRecords(sftpClient, config)
+	if err != nil {
+		return err
+	}
+	var lines []Record
+	if len(records) == 0 && host.Previous != "" && host.Previous != release {
+		lines = append(lines, Record{Action: RecordPublish, Release: host.Previous})
+	}
+	lines = append(lines, Record{Time: time.Now(), Action: action, Release: release, User: os.Getenv("USER")})
+
+	if err := sshx.Mkdir(sftpClient, path.Dir(config.GetRecordsFile())); err != nil {
+		return fmt.Errorf("create %s: %w", path.Dir(config.GetRecordsFile()), err)
+	}
+	f, err := sftpClient.OpenFile(config.GetRecordsFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		return fmt.Errorf("open deployment records: %w", err)
+	}
+	defer f.Close()
+	// Not every SFTP server honours O_APPEND, seek to the end explicitly
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("seek deployment records: %w", err)
+	}
+	for _, r := range lines {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(b, '\n')); err != nil {
+			return fmt.Errorf("write deployment records: %w", err)
+		}
+	}
+	return nil
+}
+
+// recordSwitch appends a record, a failure only warns because currentLink was already switched
+func recordSwitch(host *Host, config *Config, action, release string) {
+	if err := appendRecord(host, config, action, release); err != nil {
+		host.Log.Warn("record deployment: %v", err)
+	}
+}
+
+// activeReleases replays the records into the stack of releases that were active, oldest first
+// A publish pushes its release, a rollback pops back to the release it switched to
+func activeReleases(records []Record) []string {
+	var stack []string
+	for _, r := range records {
+		if r.Action == RecordRollback {
+			if i := lastIndex(stack, r.Release); i >= 0 {
+				stack = stack[:i+1]
+				continue
+			}
+		}
+		if len(stack) > 0 && stack[len(stack)-1] == r.Release {
+			continue
+		}
+		stack = append(stack, r.Release)
+	}
+	return stack
+}
+
+// PreviousRelease returns the release that was active steps switches before current
+func PreviousRelease(records []Record, current string, steps int) (string, error) {
+	if len(records) == 0 {
+		return "", fmt.Errorf("no deployment records, use --version")
+	}
+	if steps < 1 {
+		steps = 1
+	}
+	stack := activeReleases(records)
+	i := lastIndex(stack, current)
+	if i < 0 {
+		return "", fmt.Errorf("current release %s is not in the deployment records, use --version", current)
+	}
+	if i-steps < 0 {
+		return "", fmt.Errorf("only %d earlier releases recorded before %s", i, current)
+	}
+	return stack[i-steps], nil
+}
+
+// RecordedVersion returns the version of a release directory taken from the deployment records
+// The release must be a directory right inside remoteRepo
+func RecordedVersion(config *Config, release string) (string, error) {
+	if path.Dir(release) != config.GetRemoteRepo() {
+		return "", fmt.Errorf("recorded release %s is not in %s", release, config.GetRemoteRepo())
+	}
+	return path.Base(release), nil
+}
+
+// lastIndex returns the last position of s in list, or -1
+func lastIndex(list []string, s string) int {
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i] == s {
+			return i
+		}
+	}
+	return -1
+}
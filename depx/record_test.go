@@ -0,0 +1,122 @@
+package depx
+
+import (
+	"reflect"
+	"testing"
+)
+
+// records builds publish records for releases, a release prefixed with < is a rollback to it
+func records(releases ...string) []Record {
+	var rs []Record
+	for _, r := range releases {
+		if r[0] == '<' {
+			rs = append(rs, Record{Action: RecordRollback, Release: r[1:]})
+			continue
+		}
+		rs = append(rs, Record{Action: RecordPublish, Release: r})
+	}
+	return rs
+}
+
+func TestActiveReleases(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []Record
+		want    []string
+	}{
+		{"no records", nil, nil},
+		{"publishes", records("v1", "v2", "v3"), []string{"v1", "v2", "v3"}},
+		{"republish of the active release", records("v1", "v2", "v2"), []string{"v1", "v2"}},
+		{"rollback pops", records("v1", "v2", "v3", "<v2"), []string{"v1", "v2"}},
+		{"rollback several steps", records("v1", "v2", "v3", "<v1"), []string{"v1"}},
+		{"publish after a rollback", records("v1", "v2", "v3", "<v2", "v4"), []string{"v1", "v2", "v4"}},
+		{"rollback to an unrecorded release", records("v2", "v3", "<v1"), []string{"v2", "v3", "v1"}},
+		{"rollback to a release published twice", records("v1", "v2", "v1", "v3", "<v1"), []string{"v1", "v2", "v1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := activeReleases(tt.records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("activeReleases() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreviousRelease(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []Record
+		current string
+		steps   int
+		want    string
+		wantErr bool
+	}{
+		{name: "no records", current: "v1", steps: 1, wantErr: true},
+		{name: "one step", records: records("v1", "v2", "v3"), current: "v3", steps: 1, want: "v2"},
+		{name: "steps below 1 mean 1", records: records("v1", "v2", "v3"), current: "v3", steps: 0, want: "v2"},
+		{name: "two steps", records: records("v1", "v2", "v3"), current: "v3", steps: 2, want: "v1"},
+		{name: "too many steps", records: records("v1", "v2", "v3"), current: "v3", steps: 3, wantErr: true},
+		{name: "first release", records: records("v1"), current: "v1", steps: 1, wantErr: true},
+		{name: "current not recorded", records: records("v1", "v2"), current: "v9", steps: 1, wantErr: true},
+		{name: "after a rollback", records: records("v1", "v2", "v3", "<v2"), current: "v2", steps: 1, want: "v1"},
+		{name: "does not return to the rolled back release", records: records("v1", "v2", "v3", "<v2", "v4"), current: "v4", steps: 1, want: "v2"},
+		{name: "current published twice", records: records("v1", "v2", "v1"), current: "v1", steps: 1, want: "v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PreviousRelease(tt.records, tt.current, tt.steps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PreviousRelease() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("PreviousRelease() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordedVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteRepo string
+		release    string
+		want       string
+		wantErr    bool
+	}{
+		{name: "release in remoteRepo", remoteRepo: "/data/app/releases", release: "/data/app/releases/v1", want: "v1"},
+		{name: "trailing slash", remoteRepo: "/data/app/releases/", release: "/data/app/releases/v1", want: "v1"},
+		{name: "relative remoteRepo", remoteRepo: "data/app/releases", release: "/data/app/releases/v1", want: "v1"},
+		{name: "other directory", remoteRepo: "/data/app/releases", release: "/data/other/releases/v1", wantErr: true},
+		{name: "nested release", remoteRepo: "/data/app/releases", release: "/data/app/releases/v1/sub", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RecordedVersion(&Config{RemoteRepo: tt.remoteRepo}, tt.release)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RecordedVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("RecordedVersion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteRepoTrailingSlash(t *testing.T) {
+	config := &Config{RemoteRepo: "/data/app/releases/", Version: "v1"}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"remoteRepo", config.GetRemoteRepo(), "/data/app/releases"},
+		{"release", config.GetVersionRemoteDir(), "/data/app/releases/v1"},
+		{"records", config.GetRecordsFile(), "/data/app/.depctl/history.jsonl"},
+		{"lock", config.GetLockFile(), "/data/app/.depctl/lock"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package depx
+
+import (
+	"chihqiang/depctl/sshx"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// linkSharedScript links one shared path into the release: $1 is d or f, $2 the shared path, $3 the release path
+// On first deploy the shared path is seeded from the release, or created empty
+const linkSharedScript = `set -e
+link_shared() {
+  if [ ! -e "$2" ]; then
+    mkdir -p "$(dirname "$2")"
+    if [ "$1" = d ]; then
+      if [ -d "$3" ] && [ ! -L "$3" ]; then mv "$3" "$2"; else mkdir -p "$2"; fi
+    else
+      if [ -f "$3" ] && [ ! -L "$3" ]; then mv "$3" "$2"; else touch "$2"; fi
+    fi
+  fi
+  if [ "$1" = d ] && [ ! -d "$2" ]; then echo "shared path $2 is not a directory" >&2; exit 1; fi
+  if [ "$1" = f ] && [ ! -f "$2" ]; then echo "shared path $2 is not a file" >&2; exit 1; fi
+  if [ -e "$3" ] || [ -L "$3" ]; then echo "release already contains $3, exclude it from the package because it is shared" >&2; exit 1; fi
+  mkdir -p "$(dirname "$3")"
+  ln -s "$2" "$3"
+}
+`
+
+// linkShared creates the shared directory next to remoteRepo and links
+// every shared directory and file into the new release
+func linkShared(host *Host, config *Config) error {
+	if len(config.SharedDirs) == 0 && len(config.SharedFiles) == 0 {
+		return nil
+	}
+	var script strings.Builder
+	script.WriteString(linkSharedScript)
+	add := func(kind string, paths []string) {
+		for _, p := range paths {
+			p = path.Clean(p)
+			// Use %q to automatically add quotes, preventing errors with spaces or special characters in paths
+			fmt.Fprintf(&script, "link_shared %s %q %q\n", kind,
+				path.Join(config.GetSharedDir(), p),
+				path.Join(config.GetVersionRemoteDir(), p))
+		}
+	}
+	add("d", config.SharedDirs)
+	add("f", config.SharedFiles)
+	if output, err := sshx.Command(host.Client, script.String()); err != nil {
+		return fmt.Errorf("link shared paths: %s: %w", strings.TrimSpace(output), err)
+	}
+	return nil
+}
+
+// validateSharedPath checks that a shared path stays inside the release
+func validateSharedPath(p string) error {
+	clean := path.Clean(p)
+	if p == "" || path.IsAbs(p) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("shared path %q must be a relative path inside the release", p)
+	}
+	return nil
+}
@@ -10,20 +10,67 @@ import (
 
 const (
 	DefaultTimeout            = 30 * time.Second
+	DefaultLockTimeout        = time.Hour
 	DefaultRemoteRepoPattern  = "/data/wwwroot/%s/releases"
 	DefaultCurrentLinkPattern = "/data/wwwroot/%s/current"
 )
 
 const (
-	FlagDir     = "dir"
-	FlagVersion = "version"
-	FlagInclude = "include"
-	FlagExclude = "exclude"
+	FlagConfig = "config"
+	FlagStage  = "stage"
+
+	FlagDir        = "dir"
+	FlagVersion    = "version"
+	FlagInclude    = "include"
+	FlagArtifact   = "artifact"
+	FlagGitRef     = "git-ref"
+	FlagAllowDirty = "allow-dirty"
+	FlagExclude    = "exclude"
+
+	FlagRespectGitignore = "respect-gitignore"
+	FlagOwner            = "owner"
+	FlagGroup            = "group"
+	FlagReproducible     = "reproducible"
+	FlagCompression      = "compression"
+	FlagCompressionLevel = "compression-level"
+	FlagDelta            = "delta"
+
+	FlagTwoPhase = "two-phase"
+	FlagKeep     = "keep"
+
+	FlagSharedDir  = "shared-dir"
+	FlagSharedFile = "shared-file"
+
+	FlagHealthHTTP    = "health-http"
+	FlagHealthTCP     = "health-tcp"
+	FlagHealthCmd     = "health-cmd"
+	FlagHealthRetries = "health-retries"
+	FlagHealthTimeout = "health-timeout"
+
+	FlagSteps = "steps"
+
+	FlagOlderThan = "older-than"
+	FlagDryRun    = "dry-run"
 
 	FlagHosts      = "hosts"
 	FlagKey        = "key"
 	FlagPassphrase = "passphrase"
 	FlagTimeout    = "timeout"
+	FlagParallel   = "parallel"
+
+	FlagAllowPartial = "allow-partial"
+	FlagLockTimeout  = "lock-timeout"
+	FlagForce        = "force"
+
+	FlagKnownHosts   = "known-hosts"
+	FlagHostKeyCheck = "host-key-check"
+	FlagNoAgent      = "no-agent"
+	FlagSSHConfig    = "ssh-config"
+
+	FlagJump           = "jump"
+	FlagJumpKey        = "jump-key"
+	FlagJumpPassword   = "jump-password"
+	FlagJumpPassphrase = "jump-passphrase"
 
 	FlagRemoteRepo  = "remote-repo"
 	FlagCurrentLink = "current-link"
@@ -32,10 +79,27 @@ const (
 )
 
 const (
+	EnvConfig = "DEPCTL_CONFIG"
+	EnvStage  = "DEPCTL_STAGE"
+
 	EnvHosts      = "DEPCTL_HOSTS"
 	EnvKey        = "DEPCTL_KEY"
 	EnvPassphrase = "DEPCTL_PASSPHRASE"
 	EnvTimeout    = "DEPCTL_TIMEOUT"
+	EnvParallel   = "DEPCTL_PARALLEL"
+
+	EnvAllowPartial = "DEPCTL_ALLOW_PARTIAL"
+	EnvLockTimeout  = "DEPCTL_LOCK_TIMEOUT"
+
+	EnvKnownHosts   = "DEPCTL_KNOWN_HOSTS"
+	EnvHostKeyCheck = "DEPCTL_HOST_KEY_CHECK"
+	EnvNoAgent      = "DEPCTL_NO_AGENT"
+	EnvSSHConfig    = "DEPCTL_SSH_CONFIG"
+
+	EnvJump           = "DEPCTL_JUMP"
+	EnvJumpKey        = "DEPCTL_JUMP_KEY"
+	EnvJumpPassword   = "DEPCTL_JUMP_PASSWORD"
+	EnvJumpPassphrase = "DEPCTL_JUMP_PASSPHRASE"
 
 	EnvHookPre  = "DEPCTL_HOOK_PRE"
 	EnvHookPost = "DEPCTL_HOOK_POST"
@@ -57,13 +121,113 @@ func PublishFlags() []cli.Flag {
 			Usage: "Local directory or packaged file directory",
 			Value: dir,
 		},
+		&cli.StringFlag{
+			Name:  FlagArtifact,
+			Usage: "Pre-built tar.gz or zip archive to deploy instead of packing --dir, for example build/app.tar.gz",
+		},
+		&cli.StringFlag{
+			Name:  FlagGitRef,
+			Usage: "Pack the committed tree of this git tag, branch or commit instead of the working tree of --dir",
+		},
+		&cli.BoolFlag{
+			Name:  FlagAllowDirty,
+			Usage: "Pack a git working tree with uncommitted or untracked files",
+		},
 		&cli.StringSliceFlag{
 			Name:  FlagInclude,
-			Usage: "Files or directories to include when packaging, relative to --dir",
+			Usage: "Gitignore-style patterns of files or directories to include when packaging, relative to --dir, for example /src or *.php",
 		},
 		&cli.StringSliceFlag{
 			Name:  FlagExclude,
-			Usage: "Files or directories to exclude when packaging, relative to --dir",
+			Usage: "Gitignore-style patterns of files or directories to exclude when packaging, relative to --dir, for example *.log or **/node_modules",
+		},
+		&cli.BoolFlag{
+			Name:  FlagRespectGitignore,
+			Usage: "Also exclude what .gitignore files in --dir and its subdirectories ignore, and the .git directory",
+		},
+		&cli.StringFlag{
+			Name:  FlagOwner,
+			Usage: "Owner of the archived files instead of the local one: name, uid or name:uid, for example www-data:33",
+		},
+		&cli.StringFlag{
+			Name:  FlagGroup,
+			Usage: "Group of the archived files instead of the local one: name, gid or name:gid, for example www-data:33",
+		},
+		&cli.StringFlag{
+			Name:  FlagCompression,
+			Usage: "Compression of the uploaded archive: gzip, zstd, xz or none; zstd and xz need support in the remote tar",
+			Value: "gzip",
+		},
+		&cli.IntFlag{
+			Name:  FlagCompressionLevel,
+			Usage: "Compression level: gzip 1-9, zstd 1-22, xz 1-9; 0 is the default of the format",
+		},
+		&cli.BoolFlag{
+			Name:  FlagDelta,
+			Usage: "Upload only files changed since the current release of each host, hard-linking unchanged files from it",
+		},
+		&cli.BoolFlag{
+			Name:  FlagReproducible,
+			Usage: "Pack byte-identical archives from identical trees: timestamps from SOURCE_DATE_EPOCH or the Unix epoch, owners uid 0 unless --owner or --group",
+		},
+		&cli.BoolFlag{
+			Name:  FlagDryRun,
+			Usage: "Only check every host and show what would be uploaded, created, run and switched",
+		},
+		&cli.BoolFlag{
+			Name:  FlagTwoPhase,
+			Usage: "Upload and prepare every host first, then switch currentLink on all hosts together; nothing switches if any host fails",
+		},
+		&cli.IntFlag{
+			Name:  FlagKeep,
+			Usage: "Number of releases to keep after a successful deployment, older ones are removed (0 keeps all)",
+		},
+		&cli.StringSliceFlag{
+			Name:  FlagSharedDir,
+			Usage: "Directories kept in shared/ next to the releases and linked into every release, relative to the release",
+		},
+		&cli.StringSliceFlag{
+			Name:  FlagSharedFile,
+			Usage: "Files kept in shared/ next to the releases and linked into every release, relative to the release",
+		},
+		&cli.StringSliceFlag{
+			Name:  FlagHealthHTTP,
+			Usage: "URL that must answer 200 after switching, requested from the remote host, for example http://127.0.0.1:8080/health",
+		},
+		&cli.StringSliceFlag{
+			Name:  FlagHealthTCP,
+			Usage: "Address that must accept connections after switching, dialed from the remote host, for example 127.0.0.1:9000",
+		},
+		&cli.StringSliceFlag{
+			Name:  FlagHealthCmd,
+			Usage: "Remote command that must exit with status 0 after switching",
+		},
+		&cli.IntFlag{
+			Name:  FlagHealthRetries,
+			Value: 3,
+			Usage: "Attempts of each health check before rolling back to the previous release, also for checks of the project file without retries",
+		},
+		&cli.DurationFlag{
+			Name:  FlagHealthTimeout,
+			Value: 10 * time.Second,
+			Usage: "Timeout of each health check attempt, also for checks of the project file without a timeout",
+		},
+	}
+}
+
+func PruneFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  FlagKeep,
+			Usage: "Number of newest releases to keep, the current and previous releases are always kept",
+		},
+		&cli.DurationFlag{
+			Name:  FlagOlderThan,
+			Usage: "Only remove releases older than this, for example 720h",
+		},
+		&cli.BoolFlag{
+			Name:  FlagDryRun,
+			Usage: "Only show which releases would be removed",
 		},
 	}
 }
@@ -73,19 +237,55 @@ func VersionFlags() []cli.Flag {
 		&cli.StringFlag{
 			Name:    FlagVersion,
 			Aliases: []string{"V"},
-			Usage:   "Specify the version or branch to deploy, default is main",
-			Value:   time.Now().Format("20060102150405"),
+			Usage:   "Version of the release, default is git describe of --git-ref or the working tree, or the current time outside git",
+		},
+	}
+}
+
+func RollbackFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    FlagVersion,
+			Aliases: []string{"V"},
+			Usage:   "Version to roll back to, default is the release that was active before the current one",
+		},
+		&cli.IntFlag{
+			Name:  FlagSteps,
+			Value: 1,
+			Usage: "Number of releases to go back in the deployment records when no --version is given",
+		},
+		&cli.BoolFlag{
+			Name:  FlagDryRun,
+			Usage: "Only show which release every host would switch to and which hooks would run",
+		},
+	}
+}
+
+func UnlockFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  FlagForce,
+			Usage: "Remove the lock even when it is held by another user or machine",
 		},
 	}
 }
 
 func SSHFlags() []cli.Flag {
 	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    FlagConfig,
+			Usage:   "Path to the project file, default is depctl.yaml in --dir or the working directory",
+			Sources: cli.EnvVars(EnvConfig),
+		},
+		&cli.StringFlag{
+			Name:    FlagStage,
+			Usage:   "Stage from the project file to deploy to, can also be given as the first argument",
+			Sources: cli.EnvVars(EnvStage),
+		},
 		&cli.StringSliceFlag{
-			Name:     FlagHosts,
-			Usage:    "List of remote hosts, format: user[:password]@host[:port]",
-			Required: true,
-			Sources:  cli.EnvVars(EnvHosts),
+			Name:    FlagHosts,
+			Usage:   "List of remote hosts, format: user[:password]@host[:port] or a Host alias from ~/.ssh/config",
+			Sources: cli.EnvVars(EnvHosts),
 		},
 		&cli.StringFlag{
 			Name:    FlagKey,
@@ -103,6 +303,66 @@ func SSHFlags() []cli.Flag {
 			Usage:   "SSH connection timeout",
 			Sources: cli.EnvVars(EnvTimeout),
 		},
+		&cli.IntFlag{
+			Name:    FlagParallel,
+			Value:   1,
+			Usage:   "Number of hosts to deploy to at the same time",
+			Sources: cli.EnvVars(EnvParallel),
+		},
+		&cli.StringFlag{
+			Name:    FlagAllowPartial,
+			Usage:   "Number or percentage of hosts allowed to fail before exiting with an error, for example 1 or 10%",
+			Sources: cli.EnvVars(EnvAllowPartial),
+		},
+		&cli.DurationFlag{
+			Name:    FlagLockTimeout,
+			Value:   DefaultLockTimeout,
+			Usage:   "Age after which a deploy lock left by an interrupted run is considered stale and taken over, 0 never",
+			Sources: cli.EnvVars(EnvLockTimeout),
+		},
+		&cli.StringFlag{
+			Name:    FlagKnownHosts,
+			Usage:   "known_hosts file used to verify host keys",
+			Value:   "~/.ssh/known_hosts",
+			Sources: cli.EnvVars(EnvKnownHosts),
+		},
+		&cli.StringFlag{
+			Name:    FlagHostKeyCheck,
+			Usage:   "Host key checking: strict refuses unknown hosts, accept-new records them, off disables verification",
+			Value:   "accept-new",
+			Sources: cli.EnvVars(EnvHostKeyCheck),
+		},
+		&cli.BoolFlag{
+			Name:    FlagNoAgent,
+			Usage:   "Do not use keys from ssh-agent (SSH_AUTH_SOCK)",
+			Sources: cli.EnvVars(EnvNoAgent),
+		},
+		&cli.StringFlag{
+			Name:    FlagSSHConfig,
+			Usage:   "OpenSSH client config used to resolve host aliases, users, ports, identity files and ProxyJump",
+			Value:   "~/.ssh/config",
+			Sources: cli.EnvVars(EnvSSHConfig),
+		},
+		&cli.StringSliceFlag{
+			Name:    FlagJump,
+			Usage:   "Jump hosts to tunnel through, in order, format: user[:password]@host[:port]",
+			Sources: cli.EnvVars(EnvJump),
+		},
+		&cli.StringFlag{
+			Name:    FlagJumpKey,
+			Usage:   "Path to SSH private key for the jump hosts, default is --key (optional)",
+			Sources: cli.EnvVars(EnvJumpKey),
+		},
+		&cli.StringFlag{
+			Name:    FlagJumpPassword,
+			Usage:   "Password for the jump hosts (optional)",
+			Sources: cli.EnvVars(EnvJumpPassword),
+		},
+		&cli.StringFlag{
+			Name:    FlagJumpPassphrase,
+			Usage:   "Passphrase for the jump hosts private key (optional)",
+			Sources: cli.EnvVars(EnvJumpPassphrase),
+		},
 		&cli.StringFlag{
 			Name:    FlagHookPre,
 			Usage:   "Remote command to run before deployment (optional)",
@@ -4,10 +4,14 @@ go 1.23.12
 
 require (
 	github.com/chihqiang/logx v0.1.0
+	github.com/kevinburke/ssh_config v1.2.0
+	github.com/klauspost/compress v1.18.4
 	github.com/pkg/sftp v1.13.10
 	github.com/schollz/progressbar/v3 v3.19.0
+	github.com/ulikunitz/xz v0.5.17
 	github.com/urfave/cli/v3 v3.6.1
 	golang.org/x/crypto v0.41.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
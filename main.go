@@ -24,6 +24,9 @@ func main() {
 			cmdx.Publish(),
 			cmdx.History(),
 			cmdx.Rollback(),
+			cmdx.Prune(),
+			cmdx.Lock(),
+			cmdx.Unlock(),
 		},
 	}
 	if err := app.Run(context.Background(), os.Args); err != nil {
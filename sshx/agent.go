@@ -0,0 +1,48 @@
+package sshx
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// EnvAuthSock is the environment variable pointing to the ssh-agent socket
+const EnvAuthSock = "SSH_AUTH_SOCK"
+
+// sshAgent is a connection to the running ssh-agent
+type sshAgent struct {
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+// openAgent connects to the ssh-agent from SSH_AUTH_SOCK
+// Returns nil when no agent is available, agent authentication is optional
+func openAgent() *sshAgent {
+	socket := os.Getenv(EnvAuthSock)
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil
+	}
+	return &sshAgent{conn: conn, client: agent.NewClient(conn)}
+}
+
+// Signers returns the keys held by the agent, including hardware tokens exposed through it
+func (a *sshAgent) Signers() ([]ssh.Signer, error) {
+	if a == nil {
+		return nil, nil
+	}
+	return a.client.Signers()
+}
+
+// Close closes the agent connection
+func (a *sshAgent) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.conn.Close()
+}
@@ -0,0 +1,159 @@
+package sshx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key checking modes
+const (
+	HostKeyStrict    = "strict"     // Refuse hosts that are not in known_hosts
+	HostKeyAcceptNew = "accept-new" // Record unknown hosts in known_hosts (trust on first use)
+	HostKeyOff       = "off"        // Do not verify host keys at all
+)
+
+// DefaultKnownHosts is the known_hosts file used when none is configured
+const DefaultKnownHosts = "~/.ssh/known_hosts"
+
+// knownHostsMu serializes writes to known_hosts files
+var knownHostsMu sync.Mutex
+
+// hostKeyVerifier verifies server host keys against a known_hosts file
+type hostKeyVerifier struct {
+	path     string
+	mode     string
+	callback ssh.HostKeyCallback
+}
+
+// newHostKeyVerifier loads the known_hosts file for the given checking mode
+func newHostKeyVerifier(knownHostsPath, mode string) (*hostKeyVerifier, error) {
+	if mode == "" {
+		mode = HostKeyAcceptNew
+	}
+	if mode != HostKeyStrict && mode != HostKeyAcceptNew && mode != HostKeyOff {
+		return nil, fmt.Errorf("unsupported host key check mode %q, use %s, %s or %s", mode, HostKeyStrict, HostKeyAcceptNew, HostKeyOff)
+	}
+	if mode == HostKeyOff {
+		return &hostKeyVerifier{mode: mode, callback: ssh.InsecureIgnoreHostKey()}, nil
+	}
+	if knownHostsPath == "" {
+		knownHostsPath = DefaultKnownHosts
+	}
+	knownHostsPath = expandHome(knownHostsPath)
+	if _, err := os.Stat(knownHostsPath); err != nil {
+		if !os.IsNotExist(err) || mode == HostKeyStrict {
+			return nil, fmt.Errorf("known_hosts %s: %w", knownHostsPath, err)
+		}
+		// accept-new starts from an empty file
+		if err := os.MkdirAll(filepath.Dir(knownHostsPath), 0o700); err != nil {
+			return nil, fmt.Errorf("create known_hosts directory: %w", err)
+		}
+		if err := os.WriteFile(knownHostsPath, nil, 0o600); err != nil {
+			return nil, fmt.Errorf("create known_hosts: %w", err)
+		}
+	}
+	callback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("load known_hosts: %w", err)
+	}
+	return &hostKeyVerifier{path: knownHostsPath, mode: mode, callback: callback}, nil
+}
+
+// Verify is used as ssh.ClientConfig.HostKeyCallback
+func (v *hostKeyVerifier) Verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	err := v.callback(hostname, remote, key)
+	if err == nil || v.mode == HostKeyOff {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+	// 1. Known host with a different key: always refuse
+	if len(keyErr.Want) > 0 {
+		var expected []string
+		for _, want := range keyErr.Want {
+			expected = append(expected, fmt.Sprintf("%s %s (%s:%d)", want.Key.Type(), ssh.FingerprintSHA256(want.Key), want.Filename, want.Line))
+		}
+		return fmt.Errorf("host key mismatch for %s: server sent %s %s, known_hosts expects %s. The host key may have been changed or someone may be intercepting the connection",
+			hostname, key.Type(), ssh.FingerprintSHA256(key), strings.Join(expected, ", "))
+	}
+	// 2. Unknown host
+	if v.mode == HostKeyStrict {
+		return fmt.Errorf("host %s is not in %s (%s %s). Add it with ssh-keyscan or use --host-key-check %s",
+			hostname, v.path, key.Type(), ssh.FingerprintSHA256(key), HostKeyAcceptNew)
+	}
+	return v.record(hostname, key)
+}
+
+// record appends an unknown host key to known_hosts
+func (v *hostKeyVerifier) record(hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	f, err := os.OpenFile(v.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open known_hosts: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+		return fmt.Errorf("write known_hosts: %w", err)
+	}
+	return nil
+}
+
+// Algorithms returns the host key algorithms already known for addr,
+// so the server is asked for a key type that can actually be verified
+func (v *hostKeyVerifier) Algorithms(addr string) []string {
+	if v.mode == HostKeyOff {
+		return nil
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(v.callback(addr, &net.TCPAddr{IP: net.IPv4zero, Port: p}, placeholderKey{}), &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	seen := map[string]bool{}
+	for _, want := range keyErr.Want {
+		keyType := want.Key.Type()
+		if seen[keyType] {
+			continue
+		}
+		seen[keyType] = true
+		// RSA keys are negotiated with their SHA-2 signature algorithms
+		if keyType == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, keyType)
+	}
+	return algorithms
+}
+
+// placeholderKey never matches a known_hosts entry, it is used to list the known keys of a host
+type placeholderKey struct{}
+
+func (placeholderKey) Type() string                        { return "placeholder" }
+func (placeholderKey) Marshal() []byte                     { return []byte("placeholder") }
+func (placeholderKey) Verify([]byte, *ssh.Signature) error { return errors.New("placeholder key") }
+
+// expandHome expands a leading ~ to the current user's home directory
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, strings.TrimPrefix(p, "~"))
+}
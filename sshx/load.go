@@ -1,22 +1,71 @@
 package sshx
 
 import (
+	"chihqiang/depctl/confx"
 	"chihqiang/depctl/flagx"
+	"errors"
 	"github.com/urfave/cli/v3"
 	"strings"
 )
 
 func Load(cmd *cli.Command) ([]*Config, error) {
-	hosts := cmd.StringSlice(flagx.FlagHosts)
+	file, err := confx.Load(cmd)
+	if err != nil {
+		return nil, err
+	}
+	// Hosts from the command line replace the hosts of the project file,
+	// DEPCTL_HOSTS only does when no stage is selected
+	hosts := file.Hosts
+	if len(hosts) == 0 || confx.Overrides(cmd, flagx.FlagHosts) {
+		hosts = nil
+		for _, h := range cmd.StringSlice(flagx.FlagHosts) {
+			hosts = append(hosts, confx.Host{Target: h})
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("no hosts configured, use --hosts or hosts in " + confx.FileNames[0])
+	}
+	// Only an ssh config chosen explicitly must parse, the default ~/.ssh/config is read on a best effort basis
+	explicit := file.SSHConfig != "" || cmd.IsSet(flagx.FlagSSHConfig)
+	sshConfig, err := LoadSSHConfig(confx.String(cmd, flagx.FlagSSHConfig, file.SSHConfig), explicit)
+	if err != nil {
+		return nil, err
+	}
 	var configs []*Config
 	for _, h := range hosts {
-		cfg, err := ParseSSHURL(strings.TrimSpace(h))
+		cfg, err := parseTarget(strings.TrimSpace(h.Target))
 		if err != nil {
 			return nil, err
 		}
-		cfg.KeyPath = cmd.String(flagx.FlagKey)
-		cfg.Timeout = cmd.Duration(flagx.FlagTimeout)
-		cfg.Passphrase = cmd.String(flagx.FlagPassphrase)
+		// Host aliases, users, ports and identity files from ~/.ssh/config
+		if err := sshConfig.Apply(cfg); err != nil {
+			return nil, err
+		}
+		if key := confx.String(cmd, flagx.FlagKey, file.Key); key != "" {
+			cfg.KeyPath, cfg.KeyFromSSH = key, false
+		}
+		cfg.Timeout = confx.Duration(cmd, flagx.FlagTimeout, file.Timeout)
+		cfg.Passphrase = confx.String(cmd, flagx.FlagPassphrase, file.Passphrase)
+		cfg.KnownHosts = confx.String(cmd, flagx.FlagKnownHosts, file.KnownHosts)
+		cfg.HostKeyCheck = confx.String(cmd, flagx.FlagHostKeyCheck, file.HostKeyCheck)
+		cfg.NoAgent = confx.Bool(cmd, flagx.FlagNoAgent, file.NoAgent)
+		cfg.setDefaults()
+		// Jump hosts: --jump, then the host entry, then the project file, then ProxyJump from ~/.ssh/config
+		// DEPCTL_JUMP only replaces a jump host from the project file when no stage is selected
+		switch {
+		case (h.Jump == "" && file.Jump == "" && cmd.IsSet(flagx.FlagJump)) || confx.Overrides(cmd, flagx.FlagJump):
+			cfg.ProxyJump = strings.Join(cmd.StringSlice(flagx.FlagJump), ",")
+		case h.Jump != "":
+			cfg.ProxyJump = h.Jump
+		case file.Jump != "":
+			cfg.ProxyJump = file.Jump
+		}
+		cfg.JumpKeyPath = confx.String(cmd, flagx.FlagJumpKey, file.JumpKey)
+		cfg.JumpPassword = confx.String(cmd, flagx.FlagJumpPassword, file.JumpPassword)
+		cfg.JumpPassphrase = confx.String(cmd, flagx.FlagJumpPassphrase, file.JumpPassphrase)
+		if err := sshConfig.ResolveJump(cfg); err != nil {
+			return nil, err
+		}
 		configs = append(configs, cfg)
 	}
 	return configs, nil
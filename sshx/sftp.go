@@ -107,8 +107,8 @@ func Mkdir(sftpClient *sftp.Client, remotePath string) error {
 	return nil
 }
 
-// UploadFile uploads a local file to remote
-func UploadFile(sftpClient *sftp.Client, localPath, remotePath string) error {
+// UploadFile uploads a local file to remote, reporting to bar
+func UploadFile(sftpClient *sftp.Client, localPath, remotePath string, bar utilx.Progress) error {
 
 	// 2. Open local file
 	srcFile, err := os.Open(localPath)
@@ -130,10 +130,7 @@ func UploadFile(sftpClient *sftp.Client, localPath, remotePath string) error {
 	}
 	defer dstFile.Close()
 
-	// 5. Initialize progress bar
-	bar := utilx.NewProgress(stat.Size(), "Uploading")
-
-	// 6. Select buffer size based on file size
+	// 5. Select buffer size based on file size
 	const (
 		smallFileThreshold = 1024 * 1024       // 1MB
 		largeFileThreshold = 100 * 1024 * 1024 // 100MB
@@ -149,7 +146,7 @@ func UploadFile(sftpClient *sftp.Client, localPath, remotePath string) error {
 	}
 	buf := make([]byte, bufSize)
 
-	// 7. Loop to read local file and write to remote
+	// 6. Loop to read local file and write to remote
 	for {
 		n, err := srcFile.Read(buf)
 		if n > 0 {
@@ -157,7 +154,7 @@ func UploadFile(sftpClient *sftp.Client, localPath, remotePath string) error {
 			if writeErr != nil {
 				return fmt.Errorf("write failed: %w", writeErr)
 			}
-			_ = bar.Add(written)
+			_ = bar.Add64(int64(written))
 		}
 		if err != nil {
 			if err == io.EOF {
@@ -1,7 +1,12 @@
 package sshx
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -17,17 +22,58 @@ type Config struct {
 	Host       string        `yaml:"host"`       // Remote host address
 	Port       int           `yaml:"port"`       // Port, default 22
 	KeyPath    string        `yaml:"keyPath"`    // Private key path, optional
+	KeyFromSSH bool          `yaml:"-"`          // KeyPath is an IdentityFile from the ssh config, skipped when it needs a passphrase
 	Passphrase string        `yaml:"passphrase"` // Private key password, optional
 	Timeout    time.Duration `yaml:"timeout"`    // SSH connection timeout
+
+	KnownHosts   string `yaml:"knownHosts"`   // known_hosts file, default ~/.ssh/known_hosts
+	HostKeyCheck string `yaml:"hostKeyCheck"` // Host key checking mode: strict, accept-new or off
+	NoAgent      bool   `yaml:"noAgent"`      // Do not use keys from ssh-agent
+
+	ProxyJump      string    `yaml:"proxyJump"`      // Jump hosts, format: user[:password]@host[:port][,user@host[:port]]
+	JumpKeyPath    string    `yaml:"jumpKeyPath"`    // Private key path for the jump hosts, default is KeyPath
+	JumpPassword   string    `yaml:"jumpPassword"`   // Password for the jump hosts, optional
+	JumpPassphrase string    `yaml:"jumpPassphrase"` // Private key password for the jump hosts, optional
+	Jump           []*Config `yaml:"-"`              // Resolved jump hosts, dialed in order before the target
+}
+
+// Name returns the host name shown in logs, including the port when it is not 22
+func (c *Config) Name() string {
+	if c.Port == 0 || c.Port == 22 {
+		return c.Host
+	}
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
 }
 
 // Open establishes an SSH connection
+// When jump hosts are configured the connection is tunneled through each of them in order,
+// and the jump connections are closed together with the returned client
 func Open(cfg *Config) (*ssh.Client, error) {
+	var via *ssh.Client
+	for _, jump := range cfg.Jump {
+		client, err := dial(via, jump)
+		if err != nil {
+			return nil, fmt.Errorf("jump host %s: %w", jump.Host, err)
+		}
+		via = client
+	}
+	return dial(via, cfg)
+}
+
+// dial connects to cfg directly, or through the already connected via client
+// via is closed together with the returned client, or right away when dial fails
+func dial(via *ssh.Client, cfg *Config) (_ *ssh.Client, err error) {
+	defer func() {
+		if err != nil && via != nil {
+			_ = via.Close()
+		}
+	}()
 	var authMethods []ssh.AuthMethod
+	var signers []ssh.Signer
 
 	// 1. If private key is provided, prioritize private key authentication
 	if cfg.KeyPath != "" {
-		key, err := os.ReadFile(cfg.KeyPath)
+		key, err := os.ReadFile(expandHome(cfg.KeyPath))
 		if err != nil {
 			return nil, fmt.Errorf("read key error: %w", err)
 		}
@@ -38,35 +84,83 @@ func Open(cfg *Config) (*ssh.Client, error) {
 		} else {
 			signer, err = ssh.ParsePrivateKey(key)
 		}
-		if err != nil {
+		var missing *ssh.PassphraseMissingError
+		switch {
+		case err == nil:
+			signers = append(signers, signer)
+		case cfg.KeyFromSSH && errors.As(err, &missing):
+			// Like OpenSSH, leave an encrypted identity file to ssh-agent, which usually holds it unlocked
+		default:
 			return nil, fmt.Errorf("parse key error: %w", err)
 		}
+	}
 
-		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	// 2. Keys from ssh-agent are tried after the private key
+	// The agent connection is only needed during the handshake
+	var sshAgent *sshAgent
+	if !cfg.NoAgent {
+		sshAgent = openAgent()
+		defer sshAgent.Close()
+	}
+	if len(signers) > 0 || sshAgent != nil {
+		// All keys share one publickey method, the client tries each method only once
+		authMethods = append(authMethods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			agentSigners, err := sshAgent.Signers()
+			if err != nil {
+				return signers, nil
+			}
+			return append(signers, agentSigners...), nil
+		}))
 	}
 
-	// 2. If password is provided, add password authentication
+	// 3. If password is provided, add password authentication
 	if cfg.Password != "" {
 		authMethods = append(authMethods, ssh.Password(cfg.Password))
 	}
 
-	// 3. SSH client configuration
+	// 4. Host key verification against known_hosts
+	verifier, err := newHostKeyVerifier(cfg.KnownHosts, cfg.HostKeyCheck)
+	if err != nil {
+		return nil, err
+	}
+
+	// 5. Combine host:port
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+
+	// 6. SSH client configuration
 	sshConfig := &ssh.ClientConfig{
-		User:            cfg.User,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Ignore host key verification
-		Timeout:         cfg.Timeout,
+		User:              cfg.User,
+		Auth:              authMethods,
+		HostKeyCallback:   verifier.Verify,
+		HostKeyAlgorithms: verifier.Algorithms(addr),
+		Timeout:           cfg.Timeout,
 	}
 
-	// 4. Combine host:port
-	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	// 7. Establish TCP + SSH connection
+	if via == nil {
+		client, err := ssh.Dial("tcp", addr, sshConfig)
+		if err != nil {
+			return nil, fmt.Errorf("ssh dial error: %w", err)
+		}
+		return client, nil
+	}
 
-	// 5. Establish TCP + SSH connection
-	client, err := ssh.Dial("tcp", addr, sshConfig)
+	// Tunnel through the jump host
+	conn, err := via.Dial("tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("ssh dial error: %w", err)
 	}
-
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("ssh dial error: %w", err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	go func() {
+		// Close the jump connection once the tunneled connection is gone
+		_ = client.Wait()
+		_ = via.Close()
+	}()
 	return client, nil
 }
 
@@ -84,72 +178,120 @@ func Command(ssh *ssh.Client, cmd string) (string, error) {
 	return string(output), err
 }
 
+// CommandStdin executes a command with write feeding its standard input, returning stdout + stderr
+// The input is closed once write returns; when the remote command fails the write error is appended to its error
+func CommandStdin(client *ssh.Client, cmd string, write func(w io.Writer) error) (string, error) {
+	// 1. Create new session
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("new session error: %w", err)
+	}
+	defer session.Close()
+
+	// 2. Start the command and stream its input
+	var output bytes.Buffer
+	session.Stdout = &output
+	session.Stderr = &output
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := session.Start(cmd); err != nil {
+		return "", err
+	}
+	writeErr := write(stdin)
+	_ = stdin.Close()
+	if err := session.Wait(); err != nil {
+		if writeErr != nil {
+			err = fmt.Errorf("%w, writing input: %v", err, writeErr)
+		}
+		return output.String(), err
+	}
+	return output.String(), writeErr
+}
+
+// CommandContext executes a command like Command, giving up when ctx is done
+func CommandContext(ctx context.Context, client *ssh.Client, cmd string) (string, error) {
+	// 1. Create new session
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("new session error: %w", err)
+	}
+	defer session.Close()
+
+	// 2. Execute command in the background and wait for it or the context
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := session.CombinedOutput(cmd)
+		done <- result{output, err}
+	}()
+	select {
+	case r := <-done:
+		return string(r.output), r.err
+	case <-ctx.Done():
+		_ = session.Signal(ssh.SIGKILL)
+		return "", ctx.Err()
+	}
+}
+
 // ParseSSHURL parses simplified SSH URL format
 // Format: user[:password]@host[:port]
 // Returns SSH configuration object
 func ParseSSHURL(raw string) (*Config, error) {
+	cfg, err := parseTarget(raw)
+	if err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	return cfg, nil
+}
+
+// parseTarget parses user[:password]@host[:port] without filling in defaults,
+// so values from ~/.ssh/config can still be applied to what was left out
+func parseTarget(raw string) (*Config, error) {
 	if raw == "" {
 		return nil, fmt.Errorf("empty ssh target")
 	}
 
-	user := ""
-	password := ""
-	port := 22 // Default port
+	cfg := &Config{Timeout: 10 * time.Second}
+	hostPart := raw
 
 	at := strings.Split(raw, "@")
 	if len(at) == 2 {
 		// user[:password]@host[:port]
-		userPart := at[0]
-		hostPart := at[1]
+		hostPart = at[1]
 
 		// Parse user information
-		up := strings.SplitN(userPart, ":", 2)
-		user = up[0]
+		up := strings.SplitN(at[0], ":", 2)
+		cfg.User = up[0]
 		if len(up) == 2 {
-			password = up[1]
-		}
-
-		// Parse host[:port]
-		hp := strings.SplitN(hostPart, ":", 2)
-		host := hp[0]
-		if len(hp) == 2 {
-			p, err := strconv.Atoi(hp[1])
-			if err != nil {
-				return nil, fmt.Errorf("invalid port: %s", hp[1])
-			}
-			port = p
-		}
-
-		// If user is not specified, use current system user
-		if user == "" {
-			user = os.Getenv("USER")
+			cfg.Password = up[1]
 		}
-
-		return &Config{
-			User:     user,
-			Password: password,
-			Host:     host,
-			Port:     port,
-			Timeout:  10 * time.Second,
-		}, nil
 	}
 
-	// No @, only host or host:port
-	hp := strings.SplitN(raw, ":", 2)
-	host := hp[0]
+	// Parse host[:port]
+	hp := strings.SplitN(hostPart, ":", 2)
+	cfg.Host = hp[0]
 	if len(hp) == 2 {
 		p, err := strconv.Atoi(hp[1])
 		if err != nil {
 			return nil, fmt.Errorf("invalid port: %s", hp[1])
 		}
-		port = p
+		cfg.Port = p
 	}
+	return cfg, nil
+}
 
-	user = os.Getenv("USER")
-	return &Config{
-		User:    user,
-		Host:    host,
-		Port:    port,
-		Timeout: 10 * time.Second,
-	}, nil
+// setDefaults fills in the current system user and port 22 when they are not specified
+func (c *Config) setDefaults() {
+	if c.User == "" {
+		c.User = os.Getenv("USER")
+	}
+	if c.Port == 0 {
+		c.Port = 22 // Default port
+	}
 }
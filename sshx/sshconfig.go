@@ -0,0 +1,145 @@
+package sshx
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/chihqiang/logx"
+	"github.com/kevinburke/ssh_config"
+)
+
+// DefaultSSHConfig is the OpenSSH client configuration read for host aliases
+const DefaultSSHConfig = "~/.ssh/config"
+
+// SSHConfig is a parsed OpenSSH client configuration file
+type SSHConfig struct {
+	config *ssh_config.Config
+}
+
+// LoadSSHConfig parses an OpenSSH client configuration file
+// A missing file is not an error, it simply resolves nothing. Neither is a file that cannot be parsed,
+// for example because of a Match block, unless it was given explicitly; it is ignored with a warning
+func LoadSSHConfig(filename string, explicit bool) (*SSHConfig, error) {
+	s, err := loadSSHConfig(filename)
+	if err != nil && !explicit {
+		logx.Warn("%v, host aliases are not resolved through it", err)
+		return &SSHConfig{}, nil
+	}
+	return s, err
+}
+
+// loadSSHConfig parses an OpenSSH client configuration file, a missing file resolves nothing
+func loadSSHConfig(filename string) (*SSHConfig, error) {
+	if filename == "" {
+		filename = DefaultSSHConfig
+	}
+	f, err := os.Open(expandHome(filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &SSHConfig{}, nil
+		}
+		return nil, fmt.Errorf("open ssh config: %w", err)
+	}
+	defer f.Close()
+	config, err := ssh_config.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse ssh config %s: %w", filename, err)
+	}
+	return &SSHConfig{config: config}, nil
+}
+
+// get returns the first value of key for alias, or an empty string
+func (s *SSHConfig) get(alias, key string) string {
+	if s == nil || s.config == nil {
+		return ""
+	}
+	value, _ := s.config.Get(alias, key)
+	return value
+}
+
+// getAll returns every value of key for alias
+func (s *SSHConfig) getAll(alias, key string) []string {
+	if s == nil || s.config == nil {
+		return nil
+	}
+	values, _ := s.config.GetAll(alias, key)
+	return values
+}
+
+// Apply resolves HostName, User, Port, IdentityFile and ProxyJump for the host alias in cfg
+// Values given explicitly in the target (user@host:port) take precedence
+func (s *SSHConfig) Apply(cfg *Config) error {
+	alias := cfg.Host
+	if hostname := s.get(alias, "HostName"); hostname != "" {
+		cfg.Host = strings.ReplaceAll(hostname, "%h", alias)
+	}
+	if cfg.User == "" {
+		cfg.User = s.get(alias, "User")
+	}
+	if cfg.Port == 0 {
+		if port := s.get(alias, "Port"); port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return fmt.Errorf("invalid port %q for %s in ssh config", port, alias)
+			}
+			cfg.Port = p
+		}
+	}
+	if cfg.KeyPath == "" {
+		// OpenSSH silently skips identity files that do not exist
+		for _, identity := range s.getAll(alias, "IdentityFile") {
+			identity = expandHome(strings.ReplaceAll(identity, "%d", "~"))
+			if _, err := os.Stat(identity); err == nil {
+				cfg.KeyPath = identity
+				cfg.KeyFromSSH = true
+				break
+			}
+		}
+	}
+	if cfg.ProxyJump == "" {
+		cfg.ProxyJump = s.get(alias, "ProxyJump")
+	}
+	return nil
+}
+
+// ResolveJump parses the jump host list of cfg into cfg.Jump
+// Jump hosts are resolved through the ssh config as well and share the connection settings of cfg
+func (s *SSHConfig) ResolveJump(cfg *Config) error {
+	cfg.Jump = nil
+	if cfg.ProxyJump == "" || strings.EqualFold(cfg.ProxyJump, "none") {
+		return nil
+	}
+	for _, target := range strings.Split(cfg.ProxyJump, ",") {
+		jump, err := parseTarget(strings.TrimSpace(target))
+		if err != nil {
+			return fmt.Errorf("invalid jump host %q: %w", target, err)
+		}
+		if err := s.Apply(jump); err != nil {
+			return err
+		}
+		// Jump hosts have their own auth settings, falling back to the target's key
+		switch {
+		case cfg.JumpKeyPath != "":
+			jump.KeyPath, jump.KeyFromSSH = cfg.JumpKeyPath, false
+			jump.Passphrase = cfg.JumpPassphrase
+		case jump.KeyPath != "":
+			jump.Passphrase = cfg.JumpPassphrase
+		default:
+			jump.KeyPath, jump.KeyFromSSH = cfg.KeyPath, cfg.KeyFromSSH
+			jump.Passphrase = cfg.Passphrase
+		}
+		if jump.Password == "" {
+			jump.Password = cfg.JumpPassword
+		}
+		jump.Timeout = cfg.Timeout
+		jump.KnownHosts = cfg.KnownHosts
+		jump.HostKeyCheck = cfg.HostKeyCheck
+		jump.NoAgent = cfg.NoAgent
+		jump.ProxyJump = ""
+		jump.setDefaults()
+		cfg.Jump = append(cfg.Jump, jump)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package sshx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeSSHConfig(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadSSHConfig(t *testing.T) {
+	plain := "Host web\n  HostName 10.0.0.1\n  User deploy\n  Port 2222\n"
+	match := plain + "\nMatch host *.internal\n  User ops\n"
+	tests := []struct {
+		name     string
+		filename string
+		explicit bool
+		wantErr  bool
+		wantHost string
+	}{
+		{name: "plain", filename: writeSSHConfig(t, plain), wantHost: "10.0.0.1"},
+		{name: "plain explicit", filename: writeSSHConfig(t, plain), explicit: true, wantHost: "10.0.0.1"},
+		{name: "missing", filename: filepath.Join(t.TempDir(), "none"), explicit: true, wantHost: "web"},
+		{name: "match by default is ignored", filename: writeSSHConfig(t, match), wantHost: "web"},
+		{name: "match explicit fails", filename: writeSSHConfig(t, match), explicit: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := LoadSSHConfig(tt.filename, tt.explicit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadSSHConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			cfg := &Config{Host: "web"}
+			if err := s.Apply(cfg); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Host != tt.wantHost {
+				t.Errorf("Apply() host = %q, want %q", cfg.Host, tt.wantHost)
+			}
+		})
+	}
+}
@@ -2,10 +2,18 @@ package utilx
 
 import (
 	"fmt"
+	"github.com/chihqiang/logx"
 	"github.com/schollz/progressbar/v3"
 	"os"
+	"sync"
 )
 
+// Progress reports the progress of packing or uploading
+type Progress interface {
+	Add64(num int64) error
+	Set64(num int64) error
+}
+
 func NewProgress(totalSize int64, description string) *progressbar.ProgressBar {
 	return progressbar.NewOptions64(
 		totalSize,
@@ -17,3 +25,64 @@ func NewProgress(totalSize int64, description string) *progressbar.ProgressBar {
 		}),
 	)
 }
+
+// NewLogProgress reports progress as log lines every 10%
+// Used when several hosts run at once and a terminal progress bar would be interleaved
+func NewLogProgress(totalSize int64, description string, logger logx.ILogger) Progress {
+	return &logProgress{total: totalSize, description: description, logger: logger, step: -1}
+}
+
+// logProgress is a Progress that writes to a logger
+type logProgress struct {
+	mu          sync.Mutex
+	total       int64
+	current     int64
+	step        int64
+	description string
+	logger      logx.ILogger
+}
+
+// Add64 adds num bytes to the progress
+func (p *logProgress) Add64(num int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current += num
+	p.report()
+	return nil
+}
+
+// Set64 sets the progress to num bytes
+func (p *logProgress) Set64(num int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = num
+	p.report()
+	return nil
+}
+
+// report logs a line each time another 10% is reached
+func (p *logProgress) report() {
+	step := int64(10)
+	if p.total > 0 {
+		step = p.current * 10 / p.total
+	}
+	if step <= p.step {
+		return
+	}
+	p.step = step
+	p.logger.Info("%s %d%% (%s/%s)", p.description, step*10, FormatBytes(p.current), FormatBytes(p.total))
+}
+
+// FormatBytes formats a byte count for humans, for example 1.5 MB
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}